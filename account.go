@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/zackgomez/kiss-drop/api"
+)
+
+// LoginPageData is the data passed to the login template
+type LoginPageData struct {
+	Name  string
+	Next  string
+	Error string
+}
+
+// AccountPageData is the data passed to the account template
+type AccountPageData struct {
+	Name  string
+	Admin bool
+}
+
+// localRedirect returns next if it is a path on this server, and fallback
+// otherwise, so the login form can't send people to other sites
+func localRedirect(next, fallback string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return fallback
+	}
+	return next
+}
+
+// checkSignedIn returns the signed-in account, writing an error if there
+// is none
+func (h *Handlers) checkSignedIn(w http.ResponseWriter, r *http.Request) *User {
+	if h.users == nil {
+		http.Error(w, "Accounts are disabled", http.StatusNotFound)
+		return nil
+	}
+	user := h.currentUser(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+	return user
+}
+
+// HandleLoginPage handles GET and POST /login
+func (h *Handlers) HandleLoginPage(w http.ResponseWriter, r *http.Request, tmpl *Templates) {
+	if h.users == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := LoginPageData{Next: localRedirect(r.FormValue("next"), "/account")}
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		data.Name = r.PostFormValue("name")
+		user, err := h.users.Authenticate(data.Name, r.PostFormValue("password"))
+		if err != nil {
+			log.Printf("Error signing in: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if user != nil {
+			http.SetCookie(w, h.users.NewSession(user, strings.HasPrefix(h.baseURL, "https://")))
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+			return
+		}
+		data.Error = "Wrong name or password"
+		status = http.StatusUnauthorized
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := tmpl.login.Execute(w, data); err != nil {
+		log.Printf("Error rendering login page: %v", err)
+	}
+}
+
+// HandleLogout handles POST /logout
+func (h *Handlers) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleAccountPage serves the signed-in user's shares and API keys
+func (h *Handlers) HandleAccountPage(w http.ResponseWriter, r *http.Request, tmpl *Templates) {
+	if h.users == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !isReadMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.currentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login?next=/account", http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := tmpl.account.Execute(w, AccountPageData{Name: user.Name, Admin: user.Admin}); err != nil {
+		log.Printf("Error rendering account page: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
+
+// apiKeyInfo converts an API key to its response format
+func apiKeyInfo(k APIKey) api.APIKeyInfo {
+	return api.APIKeyInfo{
+		ID:        k.ID,
+		Label:     k.Label,
+		CreatedAt: k.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+}
+
+// HandleAccount handles GET /api/account
+func (h *Handlers) HandleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.checkSignedIn(w, r)
+	if user == nil {
+		return
+	}
+
+	used, err := h.storage.OwnerUsage(user.ID)
+	if err != nil {
+		log.Printf("Error computing usage for %s: %v", user.Name, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	response := api.AccountResponse{
+		ID:      user.ID,
+		Name:    user.Name,
+		Admin:   user.Admin,
+		Quota:   user.QuotaFor(h.defaultQuota),
+		Used:    used,
+		APIKeys: make([]api.APIKeyInfo, 0, len(user.APIKeys)),
+	}
+	for _, k := range user.APIKeys {
+		response.APIKeys = append(response.APIKeys, apiKeyInfo(k))
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleAccountKeys handles POST /api/account/keys. Like the admin actions
+// it only takes JSON, which other sites can't send with the session cookie.
+func (h *Handlers) HandleAccountKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.checkSignedIn(w, r)
+	if user == nil {
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req api.CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Label) > 100 {
+		http.Error(w, "label is too long", http.StatusBadRequest)
+		return
+	}
+
+	token, key, err := h.users.CreateAPIKey(user.ID, strings.TrimSpace(req.Label))
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(api.CreateAPIKeyResponse{APIKeyInfo: apiKeyInfo(*key), Key: token})
+}
+
+// HandleAccountKey handles DELETE /api/account/keys/:id
+func (h *Handlers) HandleAccountKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.checkSignedIn(w, r)
+	if user == nil {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/account/keys/")
+	if err := h.users.DeleteAPIKey(user.ID, id); err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting API key: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/zackgomez/kiss-drop/api"
+)
+
+// ErrShareNotFound is returned when changing a share that doesn't exist
+var ErrShareNotFound = errors.New("share not found")
+
+// maxAdminBatch limits how many shares one bulk request may change
+const maxAdminBatch = 1000
+
+// dirSize returns the total size of the regular files under a directory
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // skip what can't be read
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// ShareDiskUsage returns the bytes a share uses on disk, including old
+// versions and thumbnails
+func (s *Storage) ShareDiskUsage(id string) int64 {
+	if !ValidID(id) {
+		return 0
+	}
+	return dirSize(s.shareDir(id))
+}
+
+// SetExpiry changes when a share expires; nil makes it permanent
+func (s *Storage) SetExpiry(id string, expiresAt *time.Time) (*ShareMeta, error) {
+	if !ValidID(id) {
+		return nil, ErrInvalidID
+	}
+
+	unlock, err := s.lockShare(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	meta, err := s.GetShare(id)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, ErrShareNotFound
+	}
+	meta.ExpiresAt = expiresAt
+	if err := s.saveMeta(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// checkAdminLogin is requireAdmin for the dashboard: browsers without
+// admin credentials are asked for the admin token through basic auth. It
+// writes an error and returns false otherwise.
+func (h *Handlers) checkAdminLogin(w http.ResponseWriter, r *http.Request) bool {
+	if !h.adminEnabled() {
+		http.Error(w, "Admin API disabled", http.StatusForbidden)
+		return false
+	}
+	if h.isAdmin(r) {
+		return true
+	}
+	if h.adminToken == "" {
+		// Only accounts can sign in, so there is no password to ask for
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="kiss-drop admin", charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// checkAdminAction guards dashboard actions. Browsers resend basic auth
+// credentials on their own, so actions only take JSON bodies, which other
+// sites can't send without a CORS preflight.
+func (h *Handlers) checkAdminAction(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !h.checkAdminLogin(w, r) {
+		return false
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+// HandleAdminPage serves the admin dashboard
+func (h *Handlers) HandleAdminPage(w http.ResponseWriter, r *http.Request, tmpl *Templates) {
+	if !isReadMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.adminToken == "" && h.users != nil && !h.isAdmin(r) {
+		http.Redirect(w, r, "/login?next=/admin", http.StatusSeeOther)
+		return
+	}
+	if !h.checkAdminLogin(w, r) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if err := tmpl.admin.Execute(w, nil); err != nil {
+		log.Printf("Error rendering admin page: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
+
+// AdminShareItem is a share as listed on the admin dashboard
+type AdminShareItem struct {
+	api.ShareListItem
+	URL       string `json:"url"`
+	Versions  int    `json:"versions"`
+	DiskUsage int64  `json:"diskUsage"`
+	Private   bool   `json:"private,omitempty"`
+	Expired   bool   `json:"expired,omitempty"`
+}
+
+// DiskUsageResponse breaks down the disk space used by kiss-drop
+type DiskUsageResponse struct {
+	Shares  int64 `json:"shares"`
+	Uploads int64 `json:"uploads"`
+}
+
+// AdminStatusResponse is everything the admin dashboard shows
+type AdminStatusResponse struct {
+	Shares   []AdminShareItem    `json:"shares"`
+	Sessions []UploadSessionJSON `json:"sessions"`
+	Cleanups []CleanupRun        `json:"cleanups"`
+	Disk     DiskUsageResponse   `json:"disk"`
+}
+
+// HandleAdminStatus handles GET /api/admin/status
+func (h *Handlers) HandleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.checkAdminLogin(w, r) {
+		return
+	}
+
+	shares, err := h.storage.ListShares(0)
+	if err != nil {
+		log.Printf("Error listing shares: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	response := AdminStatusResponse{
+		Shares:   make([]AdminShareItem, 0, len(shares)),
+		Sessions: h.uploads.ListSessions(),
+		Cleanups: h.storage.CleanupHistory(),
+		Disk:     DiskUsageResponse{Uploads: h.uploads.DiskUsage()},
+	}
+	for _, meta := range shares {
+		item := AdminShareItem{
+			ShareListItem: h.shareListItem(meta),
+			URL:           h.shareURL(meta.ID),
+			Versions:      len(meta.Versions) + 1,
+			DiskUsage:     h.storage.ShareDiskUsage(meta.ID),
+			Private:       meta.Private,
+			Expired:       meta.ExpiresAt != nil && meta.ExpiresAt.Before(now),
+		}
+		response.Disk.Shares += item.DiskUsage
+		response.Shares = append(response.Shares, item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// AdminBatchResponse reports the outcome of a bulk action
+type AdminBatchResponse struct {
+	Updated int               `json:"updated"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// checkBatchIDs validates the shares named by a bulk action, writing an
+// error if there are none or too many
+func checkBatchIDs(w http.ResponseWriter, ids []string) bool {
+	if len(ids) == 0 || len(ids) > maxAdminBatch {
+		http.Error(w, "ids must list 1 to 1000 shares", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// HandleAdminDelete handles POST /api/admin/delete, deleting the listed shares
+func (h *Handlers) HandleAdminDelete(w http.ResponseWriter, r *http.Request) {
+	if !h.checkAdminAction(w, r) {
+		return
+	}
+
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !checkBatchIDs(w, req.IDs) {
+		return
+	}
+
+	var response AdminBatchResponse
+	for _, id := range req.IDs {
+		if !h.storage.ShareExists(id) {
+			response.addError(id, ErrShareNotFound)
+			continue
+		}
+		if err := h.storage.DeleteShare(id); err != nil {
+			log.Printf("Error deleting share %s: %v", id, err)
+			response.addError(id, err)
+			continue
+		}
+		h.audit(r, AuditEvent{Event: AuditDelete, ShareID: id})
+		response.Updated++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleAdminExpiry handles POST /api/admin/expiry, changing when the listed
+// shares expire
+func (h *Handlers) HandleAdminExpiry(w http.ResponseWriter, r *http.Request) {
+	if !h.checkAdminAction(w, r) {
+		return
+	}
+
+	var req struct {
+		IDs       []string   `json:"ids"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+		Permanent bool       `json:"permanent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !checkBatchIDs(w, req.IDs) {
+		return
+	}
+	if (req.ExpiresAt == nil) == !req.Permanent {
+		http.Error(w, "Set exactly one of expiresAt and permanent", http.StatusBadRequest)
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		t := req.ExpiresAt.UTC()
+		expiresAt = &t
+	}
+
+	var response AdminBatchResponse
+	for _, id := range req.IDs {
+		if _, err := h.storage.SetExpiry(id, expiresAt); err != nil {
+			if !errors.Is(err, ErrShareNotFound) && !errors.Is(err, ErrInvalidID) {
+				log.Printf("Error setting expiry of share %s: %v", id, err)
+			}
+			response.addError(id, err)
+			continue
+		}
+		h.audit(r, AuditEvent{Event: AuditExpiry, ShareID: id, Detail: expiryDetail(expiresAt)})
+		response.Updated++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// addError records a failed share in a bulk action response
+func (resp *AdminBatchResponse) addError(id string, err error) {
+	if resp.Errors == nil {
+		resp.Errors = make(map[string]string)
+	}
+	resp.Errors[id] = err.Error()
+}
+
+// HandleAdminCleanup handles POST /api/admin/cleanup, removing expired
+// shares right away
+func (h *Handlers) HandleAdminCleanup(w http.ResponseWriter, r *http.Request) {
+	if !h.checkAdminAction(w, r) {
+		return
+	}
+
+	run, err := h.storage.CleanupExpired(CleanupManual)
+	if err != nil {
+		log.Printf("Cleanup error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if run.Deleted > 0 {
+		log.Printf("Cleaned up %d expired share(s)", run.Deleted)
+	}
+	h.audit(r, AuditEvent{Event: AuditCleanup, Bytes: run.FreedBytes, Detail: fmt.Sprintf("deleted %d", run.Deleted)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// defaultAuditLimit and maxAuditLimit bound the events one audit query returns
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 10000
+)
+
+// AdminAuditResponse lists audit log events, oldest first
+type AdminAuditResponse struct {
+	Events []AuditEvent `json:"events"`
+}
+
+// HandleAdminAudit handles GET /api/admin/audit, returning the latest audit
+// events, optionally only those of one share (?share_id=)
+func (h *Handlers) HandleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.checkAdminLogin(w, r) {
+		return
+	}
+	if h.auditLog == nil {
+		http.Error(w, "Audit log disabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	shareID := q.Get("share_id")
+	if shareID != "" && !ValidID(shareID) {
+		http.Error(w, "Invalid share ID", http.StatusBadRequest)
+		return
+	}
+	limit := defaultAuditLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxAuditLimit {
+			http.Error(w, "limit must be 1 to 10000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events, err := h.auditLog.Query(shareID, limit)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []AuditEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(AdminAuditResponse{Events: events})
+}
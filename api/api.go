@@ -0,0 +1,123 @@
+// Package api defines the JSON bodies of the kiss-drop HTTP API. The server
+// and the Go client both use these types, so they can't drift apart.
+package api
+
+// Finalize job states
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// InitUploadRequest is the body of POST /api/upload/init
+type InitUploadRequest struct {
+	FileName     string `json:"fileName"`
+	FileSize     int64  `json:"fileSize"`
+	ExpiresIn    string `json:"expiresIn,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
+	RequestID    string `json:"requestId,omitempty"`
+	ShareID      string `json:"shareId,omitempty"`
+	KeepMetadata bool   `json:"keepMetadata,omitempty"`
+	Private      bool   `json:"private,omitempty"`
+	Slug         string `json:"slug,omitempty"`
+}
+
+// InitUploadResponse is returned when starting a new upload
+type InitUploadResponse struct {
+	UploadID    string `json:"uploadId"`
+	ChunkSize   int64  `json:"chunkSize"`
+	TotalChunks int    `json:"totalChunks"`
+	ManageToken string `json:"manageToken,omitempty"`
+}
+
+// ChunkResponse is returned after receiving a chunk
+type ChunkResponse struct {
+	Received int `json:"received"`
+}
+
+// FinalizeStatusResponse describes the background assembly of a chunked
+// upload, returned by complete and status
+type FinalizeStatusResponse struct {
+	JobID          string `json:"jobId"`
+	UploadID       string `json:"uploadId"`
+	Status         string `json:"status"`
+	BytesProcessed int64  `json:"bytesProcessed"`
+	TotalBytes     int64  `json:"totalBytes"`
+	StatusURL      string `json:"statusUrl"`
+	ID             string `json:"id,omitempty"`
+	URL            string `json:"url,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// ShareInfoResponse is the JSON response for share metadata
+type ShareInfoResponse struct {
+	ID           string                 `json:"id"`
+	FileName     string                 `json:"fileName"`
+	FileSize     int64                  `json:"fileSize"`
+	ExpiresAt    *string                `json:"expiresAt,omitempty"`
+	SHA256       string                 `json:"sha256,omitempty"`
+	Stripped     bool                   `json:"metadataStripped,omitempty"`
+	DetectedType string                 `json:"detectedType,omitempty"`
+	PreviewKind  string                 `json:"previewKind,omitempty"`
+	Version      int                    `json:"version"`
+	Versions     []ShareVersionResponse `json:"versions,omitempty"`
+}
+
+// ShareVersionResponse is the JSON response for one version of a share's file
+type ShareVersionResponse struct {
+	Version   int    `json:"version"`
+	FileName  string `json:"fileName"`
+	FileSize  int64  `json:"fileSize"`
+	SHA256    string `json:"sha256,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// ShareListItem is the JSON response for a share in the list
+type ShareListItem struct {
+	ID           string  `json:"id"`
+	FileName     string  `json:"fileName"`
+	FileSize     int64   `json:"fileSize"`
+	CreatedAt    string  `json:"createdAt"`
+	ExpiresAt    *string `json:"expiresAt,omitempty"`
+	UploaderIP   string  `json:"uploaderIP,omitempty"`
+	UserAgent    string  `json:"userAgent,omitempty"`
+	ContentType  string  `json:"contentType,omitempty"`
+	RequestID    string  `json:"requestId,omitempty"`
+	OwnerID      string  `json:"ownerId,omitempty"`
+	ThumbnailURL string  `json:"thumbnailUrl,omitempty"`
+}
+
+// ShareListResponse is a page of shares from GET /api/shares
+type ShareListResponse struct {
+	Shares     []ShareListItem `json:"shares"`
+	Total      int             `json:"total"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+// AccountResponse is the signed-in user from GET /api/account
+type AccountResponse struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	Admin   bool         `json:"admin,omitempty"`
+	Quota   int64        `json:"quota"` // bytes; 0 = unlimited
+	Used    int64        `json:"used"`
+	APIKeys []APIKeyInfo `json:"apiKeys"`
+}
+
+// APIKeyInfo describes an API key without revealing it
+type APIKeyInfo struct {
+	ID        string `json:"id"`
+	Label     string `json:"label,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// CreateAPIKeyRequest is the body of POST /api/account/keys
+type CreateAPIKeyRequest struct {
+	Label string `json:"label"`
+}
+
+// CreateAPIKeyResponse holds a new API key, which is only shown once
+type CreateAPIKeyResponse struct {
+	APIKeyInfo
+	Key string `json:"key"`
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Archive formats we can list and extract from
+const (
+	ArchiveZip   = "zip"
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+)
+
+const (
+	archiveIndexName  = "archive.json"
+	maxArchiveEntries = 10000   // archives with more entries aren't listed
+	maxArchiveRatio   = 100     // decompressed bytes allowed per compressed byte
+	archiveRatioSlack = 1 << 20 // output allowed before the ratio applies
+	maxArchiveScan    = 1 << 30 // decompressed bytes read to list a tar.gz
+)
+
+var (
+	errTooManyEntries = errors.New("too many archive entries")
+	errArchiveBomb    = errors.New("compression ratio too high")
+	errArchiveTooBig  = errors.New("too much data to decompress")
+)
+
+// ArchiveEntry is one regular file inside an archive
+type ArchiveEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// ArchiveIndex lists the files in an archive. It is built once at upload and
+// stored next to the archive.
+type ArchiveIndex struct {
+	Format    string         `json:"format"`
+	Entries   []ArchiveEntry `json:"entries"`
+	TotalSize int64          `json:"total_size"`
+}
+
+// Find returns the entry with the given path, or nil
+func (idx *ArchiveIndex) Find(p string) *ArchiveEntry {
+	for i := range idx.Entries {
+		if idx.Entries[i].Path == p {
+			return &idx.Entries[i]
+		}
+	}
+	return nil
+}
+
+// cleanEntryPath normalizes an entry name, rejecting absolute paths and
+// anything that escapes the archive root (zip-slip)
+func cleanEntryPath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", false
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return clean, true
+}
+
+// archiveFormat sniffs whether a file is a zip, tar or gzipped tar
+func archiveFormat(f *os.File) string {
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	defer f.Seek(0, io.SeekStart)
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return ArchiveZip
+	case isTarHeader(head):
+		return ArchiveTar
+	case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return ""
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return ""
+		}
+		inner := make([]byte, 512)
+		n, _ := io.ReadFull(gz, inner)
+		if isTarHeader(inner[:n]) {
+			return ArchiveTarGz
+		}
+	}
+	return ""
+}
+
+// isTarHeader checks for the ustar magic in a tar header block
+func isTarHeader(block []byte) bool {
+	return len(block) >= 262 && string(block[257:262]) == "ustar"
+}
+
+// zipEntryCount reads the entry count from a zip's end of central directory
+// record, so oversized archives are refused before archive/zip loads them
+func zipEntryCount(f *os.File, size int64) (int, error) {
+	const eocdLen = 22
+	tail := min(size, eocdLen+0xFFFF) // the record plus the longest comment
+	buf := make([]byte, tail)
+	if _, err := f.ReadAt(buf, size-tail); err != nil {
+		return 0, err
+	}
+	i := bytes.LastIndex(buf, []byte("PK\x05\x06"))
+	if i < 0 || i+eocdLen > len(buf) {
+		return 0, fmt.Errorf("no end of central directory")
+	}
+	count := int(binary.LittleEndian.Uint16(buf[i+10:]))
+	if count == 0xFFFF {
+		// Zip64 archive with at least this many entries
+		return 0, errTooManyEntries
+	}
+	return count, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// bombGuard fails once a decompressed stream outgrows its compressed input
+// by more than maxArchiveRatio, or passes maxArchiveScan bytes in all, so
+// listing or extracting never decompresses more than that
+type bombGuard struct {
+	r   io.Reader
+	in  *countingReader
+	out int64
+}
+
+func (g *bombGuard) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	g.out += int64(n)
+	if g.out > archiveRatioSlack && g.out > g.in.n*maxArchiveRatio {
+		return n, errArchiveBomb
+	}
+	if g.out > maxArchiveScan {
+		return n, errArchiveTooBig
+	}
+	return n, err
+}
+
+// openTar returns a tar reader over a plain or gzipped tar file
+func openTar(f *os.File, format string) (*tar.Reader, error) {
+	if format == ArchiveTar {
+		return tar.NewReader(f), nil
+	}
+	in := &countingReader{r: f}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	return tar.NewReader(&bombGuard{r: gz, in: in}), nil
+}
+
+// buildArchiveIndex lists the regular files in an archive. It returns nil for
+// files that aren't archives or can't be listed safely.
+func buildArchiveIndex(filePath string) *ArchiveIndex {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	format := archiveFormat(f)
+	if format == "" {
+		return nil
+	}
+
+	var idx *ArchiveIndex
+	if format == ArchiveZip {
+		idx, err = indexZip(f)
+	} else {
+		idx, err = indexTar(f, format)
+	}
+	if err != nil {
+		log.Printf("Not listing archive %s: %v", filePath, err)
+		return nil
+	}
+	idx.Format = format
+	return idx
+}
+
+// indexZip lists a zip archive from its central directory
+func indexZip(f *os.File) (*ArchiveIndex, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	count, err := zipEntryCount(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if count > maxArchiveEntries {
+		return nil, errTooManyEntries
+	}
+
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	idx := &ArchiveIndex{}
+	for _, zf := range zr.File {
+		name, ok := cleanEntryPath(zf.Name)
+		if !ok || !zf.Mode().IsRegular() {
+			continue
+		}
+		size := int64(zf.UncompressedSize64)
+		idx.Entries = append(idx.Entries, ArchiveEntry{Path: name, Size: size})
+		idx.TotalSize += size
+	}
+	return idx, nil
+}
+
+// indexTar lists a tar archive by reading through it
+func indexTar(f *os.File, format string) (*ArchiveIndex, error) {
+	tr, err := openTar(f, format)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &ArchiveIndex{}
+	for seen := 0; ; seen++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return idx, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if seen >= maxArchiveEntries {
+			return nil, errTooManyEntries
+		}
+		name, ok := cleanEntryPath(hdr.Name)
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		idx.Entries = append(idx.Entries, ArchiveEntry{Path: name, Size: hdr.Size})
+		idx.TotalSize += hdr.Size
+	}
+}
+
+// saveArchiveIndex writes an archive listing into dir, removing any stale one
+// when idx is nil
+func saveArchiveIndex(dir string, idx *ArchiveIndex) error {
+	indexPath := filepath.Join(dir, archiveIndexName)
+	if idx == nil {
+		if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("encoding archive index: %w", err)
+	}
+	return os.WriteFile(indexPath, data, 0644)
+}
+
+// GetArchiveIndex returns the listing for a share version, or nil if the
+// version isn't a listable archive
+func (s *Storage) GetArchiveIndex(meta *ShareMeta, v *ShareVersion) (*ArchiveIndex, error) {
+	indexPath := filepath.Join(filepath.Dir(s.GetVersionPath(meta, v)), archiveIndexName)
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading archive index: %w", err)
+	}
+
+	var idx ArchiveIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("parsing archive index: %w", err)
+	}
+	return &idx, nil
+}
+
+// openArchiveEntry opens a single entry of an archive for streaming
+func openArchiveEntry(f *os.File, format, entryPath string) (io.ReadCloser, error) {
+	if format == ArchiveZip {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		for _, zf := range zr.File {
+			if name, ok := cleanEntryPath(zf.Name); !ok || name != entryPath || !zf.Mode().IsRegular() {
+				continue
+			}
+			size := zf.UncompressedSize64
+			if size > archiveRatioSlack && size > max(zf.CompressedSize64, 1)*maxArchiveRatio {
+				return nil, errArchiveBomb
+			}
+			// archive/zip fails the read if the data outgrows the declared size
+			return zf.Open()
+		}
+		return nil, os.ErrNotExist
+	}
+
+	tr, err := openTar(f, format)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		if name, ok := cleanEntryPath(hdr.Name); ok && name == entryPath && hdr.Typeflag == tar.TypeReg {
+			return io.NopCloser(tr), nil
+		}
+	}
+}
+
+// HandleArchiveEntry handles GET and HEAD /api/share/:id/entry?path=..., which
+// streams one file out of an archive share
+func (h *Handlers) HandleArchiveEntry(w http.ResponseWriter, r *http.Request) {
+	if !isReadMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.checkDownloader(w, r) {
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/api/share/")
+	id := strings.TrimSuffix(p, "/entry")
+	if !ValidID(id) {
+		http.Error(w, "Invalid share ID", http.StatusBadRequest)
+		return
+	}
+
+	entryPath, ok := cleanEntryPath(r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Invalid entry path", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := h.storage.GetShare(id)
+	if err != nil {
+		log.Printf("Error getting share: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if meta == nil {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+
+	version := requestedVersion(w, r, meta)
+	if version == nil {
+		return
+	}
+
+	idx, err := h.storage.GetArchiveIndex(meta, version)
+	if err != nil {
+		log.Printf("Error getting archive index: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if idx == nil {
+		http.Error(w, "Not an archive", http.StatusNotFound)
+		return
+	}
+	entry := idx.Find(entryPath)
+	if entry == nil {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(h.storage.GetVersionPath(meta, version))
+	if err != nil {
+		log.Printf("Error opening file: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	rc, err := openArchiveEntry(f, idx.Format, entryPath)
+	if err != nil {
+		if errors.Is(err, errArchiveBomb) {
+			http.Error(w, "Entry is too highly compressed to extract", http.StatusUnprocessableEntity)
+			return
+		}
+		log.Printf("Error opening archive entry: %v", err)
+		http.Error(w, "Error reading archive", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+sanitizeFileName(path.Base(entryPath))+"\"")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", h.cacheControl(meta, r.URL.Query().Get("v") != ""))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w}
+	rec.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(h.downloadLimit.Writer(rec, r), rc); err != nil {
+		// Headers are already sent; the short body tells the client it failed
+		log.Printf("Error streaming archive entry %s from %s: %v", entryPath, id, err)
+	}
+	h.audit(r, AuditEvent{
+		Event:    AuditDownload,
+		ShareID:  meta.ID,
+		Version:  version.Version,
+		FileName: version.FileName,
+		Bytes:    rec.bytes,
+		Status:   rec.status,
+		Detail:   "entry " + entryPath,
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Audit events
+const (
+	AuditUploadInit   = "upload_init"
+	AuditChunk        = "chunk"
+	AuditShareCreated = "share_created"
+	AuditVersionAdded = "version_added"
+	AuditDownload     = "download"
+	AuditUnlock       = "unlock" // a signed link was tried
+	AuditLinkSigned   = "link_signed"
+	AuditLinksRevoked = "links_revoked"
+	AuditDelete       = "delete"
+	AuditExpire       = "expire"
+	AuditExpiry       = "expiry_changed"
+	AuditCleanup      = "cleanup"
+)
+
+// Actors that aren't accounts, which are "user:<name>"
+const (
+	ActorAdmin       = "admin" // the admin token
+	ActorManageToken = "manage_token"
+	ActorAnonymous   = "anonymous"
+	ActorSystem      = "system" // the expiry cleanup
+	ActorCLI         = "cli"
+)
+
+// auditFile is the name of the current audit log in DATA_DIR/audit; rotated
+// logs get a .1, .2, ... suffix, with .1 the most recent
+const auditFile = "audit.jsonl"
+
+// AuditEvent is one line of the audit log
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	ShareID   string    `json:"share_id,omitempty"`
+	UploadID  string    `json:"upload_id,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	Actor     string    `json:"actor"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	FileName  string    `json:"file_name,omitempty"`
+	Chunk     *int      `json:"chunk,omitempty"`
+	Range     string    `json:"range,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// AuditLog appends events to a JSON Lines file, starting a new one when it
+// reaches maxSize and keeping the last few. The file is opened for every
+// write, and writes and rotation hold a lock on the directory, so the server
+// and CLI can share it. A nil AuditLog records nothing.
+type AuditLog struct {
+	dir     string
+	maxSize int64
+	keep    int
+	mu      sync.Mutex
+}
+
+// OpenAuditLog creates DATA_DIR/audit. Logs are rotated once they pass
+// maxSize bytes (0 = never), keeping keep old ones.
+func OpenAuditLog(dataDir string, maxSize int64, keep int) (*AuditLog, error) {
+	dir := filepath.Join(dataDir, "audit")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating audit directory: %w", err)
+	}
+	return &AuditLog{dir: dir, maxSize: maxSize, keep: max(keep, 0)}, nil
+}
+
+// path returns the log with the given rotation number, 0 being current
+func (a *AuditLog) path(n int) string {
+	if n == 0 {
+		return filepath.Join(a.dir, auditFile)
+	}
+	return filepath.Join(a.dir, auditFile+"."+strconv.Itoa(n))
+}
+
+// Record appends an event, filling in the time. Failures are logged rather
+// than returned, since they shouldn't fail the request being audited.
+func (a *AuditLog) Record(e AuditEvent) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error encoding audit event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	unlock, err := a.lock()
+	if err != nil {
+		log.Printf("Error locking audit log: %v", err)
+		return
+	}
+	defer unlock()
+	if err := a.rotate(int64(len(line))); err != nil {
+		log.Printf("Error rotating audit log: %v", err)
+	}
+	f, err := os.OpenFile(a.path(0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Error opening audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// lock keeps other goroutines and processes from writing or rotating the
+// log. Call the returned function when done.
+func (a *AuditLog) lock() (func(), error) {
+	a.mu.Lock()
+	unlock, err := lockDir(a.dir)
+	if err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		a.mu.Unlock()
+	}, nil
+}
+
+// rotate moves the current log aside if n more bytes would take it past
+// maxSize, dropping the oldest
+func (a *AuditLog) rotate(n int64) error {
+	if a.maxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(a.path(0))
+	if err != nil || info.Size() == 0 || info.Size()+n <= a.maxSize {
+		return nil
+	}
+	if a.keep == 0 {
+		return os.Remove(a.path(0))
+	}
+	os.Remove(a.path(a.keep))
+	for i := a.keep - 1; i >= 0; i-- {
+		if err := os.Rename(a.path(i), a.path(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the latest limit events for a share (all shares when
+// shareID is empty), oldest first, reading the rotated logs too. The logs
+// are only opened under the lock, so a rotation can't shift them between
+// opens; an open log stays readable when it's renamed, and lines still being
+// appended are skipped, so they're read without keeping writers waiting.
+func (a *AuditLog) Query(shareID string, limit int) ([]AuditEvent, error) {
+	files, err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var events []AuditEvent
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var e AuditEvent
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				continue // skip a line cut short by a crash
+			}
+			if shareID == "" || e.ShareID == shareID {
+				events = append(events, e)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f.Name(), err)
+		}
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, nil
+}
+
+// open opens every log, oldest first
+func (a *AuditLog) open() ([]*os.File, error) {
+	unlock, err := a.lock()
+	if err != nil {
+		return nil, fmt.Errorf("locking audit log: %w", err)
+	}
+	defer unlock()
+
+	var files []*os.File
+	for n := a.keep; n >= 0; n-- {
+		f, err := os.Open(a.path(n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// expiryDetail describes a new expiry in an audit event
+func expiryDetail(expiresAt *time.Time) string {
+	if expiresAt == nil {
+		return "permanent"
+	}
+	return "expires " + expiresAt.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// actor names who made a request for the audit log, by the same
+// credentials isAdmin accepts
+func (h *Handlers) actor(r *http.Request) string {
+	if h.hasAdminToken(r) {
+		return ActorAdmin
+	}
+	if user := h.currentUser(r); user != nil {
+		return "user:" + user.Name
+	}
+	return ActorAnonymous
+}
+
+// manageActor names who changed a share. Requests that got past
+// checkCanManage without being anyone else used the management token.
+func (h *Handlers) manageActor(r *http.Request) string {
+	if actor := h.actor(r); actor != ActorAnonymous {
+		return actor
+	}
+	return ActorManageToken
+}
+
+// audit records an event for a request, with its client and actor
+func (h *Handlers) audit(r *http.Request, e AuditEvent) {
+	if h.auditLog == nil {
+		return
+	}
+	e.ClientIP = h.clientIP(r)
+	e.UserAgent = r.UserAgent()
+	if e.Actor == "" {
+		e.Actor = h.actor(r)
+	}
+	h.auditLog.Record(e)
+}
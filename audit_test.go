@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// auditVersions returns the Version of each event, which the tests use as
+// a sequence number
+func auditVersions(events []AuditEvent) []int {
+	var versions []int
+	for _, e := range events {
+		versions = append(versions, e.Version)
+	}
+	return versions
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	a, err := OpenAuditLog(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"a", "b", "a", "c", "a", "b"} {
+		a.Record(AuditEvent{Event: AuditDownload, ShareID: id, Version: i + 1})
+	}
+
+	tests := []struct {
+		shareID string
+		limit   int
+		want    []int
+	}{
+		{"", 0, []int{1, 2, 3, 4, 5, 6}},
+		{"", 2, []int{5, 6}},
+		{"a", 0, []int{1, 3, 5}},
+		{"a", 2, []int{3, 5}},
+		{"b", 10, []int{2, 6}},
+		{"d", 0, nil},
+	}
+	for _, tt := range tests {
+		events, err := a.Query(tt.shareID, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := auditVersions(events); !slices.Equal(got, tt.want) {
+			t.Errorf("Query(%q, %d) = %v, want %v", tt.shareID, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		keep    int
+		files   int // logs left on disk
+	}{
+		{"never", 0, 3, 1},
+		{"keep 2", 1024, 2, 3},
+		{"keep none", 1024, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := OpenAuditLog(t.TempDir(), tt.maxSize, tt.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			const n = 100
+			for i := 1; i <= n; i++ {
+				a.Record(AuditEvent{Event: AuditDownload, ShareID: "share", Version: i})
+			}
+
+			for i := 0; i <= tt.keep+1; i++ {
+				info, err := os.Stat(a.path(i))
+				if exists := err == nil; exists != (i < tt.files) {
+					t.Errorf("log %d exists: %t, want %t", i, exists, i < tt.files)
+				}
+				if err == nil && tt.maxSize > 0 && info.Size() > tt.maxSize {
+					t.Errorf("log %d is %d bytes, over %d", i, info.Size(), tt.maxSize)
+				}
+			}
+
+			// The newest events survive, in order and without gaps
+			events, err := a.Query("", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := auditVersions(events)
+			if len(got) == 0 || got[len(got)-1] != n {
+				t.Fatalf("newest event missing: %v", got)
+			}
+			for i := 1; i < len(got); i++ {
+				if got[i] != got[i-1]+1 {
+					t.Fatalf("events out of order or missing: %v", got)
+				}
+			}
+			if tt.maxSize == 0 && len(got) != n {
+				t.Errorf("kept %d events, want %d", len(got), n)
+			}
+			if tt.maxSize > 0 && len(got) == n {
+				t.Errorf("no events were rotated away")
+			}
+		})
+	}
+}
+
+// TestAuditLogConcurrent records from several goroutines, rotating as it
+// goes, while others query
+func TestAuditLogConcurrent(t *testing.T) {
+	a, err := OpenAuditLog(t.TempDir(), 4096, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers, perWriter = 8, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				a.Record(AuditEvent{Event: AuditChunk, ShareID: "share", Version: w*perWriter + i + 1})
+			}
+		}()
+	}
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if _, err := a.Query("share", 0); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	events, err := a.Query("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := auditVersions(events)
+	slices.Sort(got)
+	for i, v := range got {
+		if v != i+1 {
+			t.Fatalf("event %d missing or duplicated among %d events", i+1, len(got))
+		}
+	}
+	if len(got) != writers*perWriter {
+		t.Errorf("got %d events, want %d", len(got), writers*perWriter)
+	}
+}
+
+func TestAuditLogNil(t *testing.T) {
+	var a *AuditLog
+	a.Record(AuditEvent{Event: AuditDownload}) // must not panic
+}
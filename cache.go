@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxCacheAge caps how long immutable responses may be cached
+const maxCacheAge = 365 * 24 * time.Hour
+
+// isReadMethod reports whether the request is a GET or HEAD
+func isReadMethod(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// versionETag returns the strong ETag for a version's content, or "" for
+// shares stored before hashes were recorded
+func versionETag(v *ShareVersion) string {
+	if v.SHA256 == "" {
+		return ""
+	}
+	return `"` + v.SHA256 + `"`
+}
+
+// cacheControl returns the Cache-Control value for a share's content. An
+// explicitly requested version never changes, so it may be cached until the
+// share expires. The latest version can be replaced at any time, so caches
+// must revalidate it (cheaply, via the ETag). When downloading requires
+// signing in, only the browser may keep a copy.
+func (h *Handlers) cacheControl(meta *ShareMeta, pinned bool) string {
+	scope := "public"
+	if h.loginToDownload {
+		scope = "private"
+	}
+	if !pinned {
+		return scope + ", no-cache"
+	}
+
+	maxAge := maxCacheAge
+	if meta.ExpiresAt != nil {
+		maxAge = min(maxAge, time.Until(*meta.ExpiresAt))
+	}
+	if maxAge <= 0 {
+		return "no-store"
+	}
+	return scope + ", max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10) + ", immutable"
+}
+
+// setContentValidators sets ETag and Cache-Control for serving a version.
+// http.ServeContent then answers If-None-Match, If-Modified-Since and
+// If-Range from these headers and the modtime it is given.
+func (h *Handlers) setContentValidators(w http.ResponseWriter, r *http.Request, meta *ShareMeta, v *ShareVersion) {
+	if etag := versionETag(v); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Cache-Control", h.cacheControl(meta, r.URL.Query().Get("v") != ""))
+}
+
+// serveJSON writes v as JSON with a strong ETag over the encoded body, so
+// clients can poll with If-None-Match. HEAD requests get headers only.
+func serveJSON(w http.ResponseWriter, r *http.Request, v any, modTime time.Time) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	sum := sha256.Sum256(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errUsage reports bad command-line arguments, after usage has been printed
+var errUsage = errors.New("usage")
+
+// Command is a subcommand. Admin commands work on DATA_DIR directly; remote
+// ones talk to a running server instead.
+type Command struct {
+	Name   string
+	Args   string
+	Short  string
+	Remote bool
+	Run    func(c *CLI, args []string) error
+}
+
+// CLI holds the state shared by admin subcommands
+type CLI struct {
+	cmd     *Command
+	storage *Storage
+	uploads *UploadManager
+	audit   *AuditLog
+	dataDir string
+	out     io.Writer
+	json    bool
+}
+
+var commands = []*Command{
+	{Name: "list", Short: "List shares", Run: cmdList},
+	{Name: "show", Args: "<id>", Short: "Show a share's details", Run: cmdShow},
+	{Name: "delete", Args: "<id>...", Short: "Delete shares", Run: cmdDelete},
+	{Name: "extend", Args: "<id> <duration|never>", Short: "Push back a share's expiry, e.g. by 7d or 12h", Run: cmdExtend},
+	{Name: "cleanup", Short: "Delete expired shares", Run: cmdCleanup},
+	{Name: "stats", Short: "Show share counts and disk usage", Run: cmdStats},
+	{Name: "gc-uploads", Short: "Delete chunks of abandoned uploads", Run: cmdGCUploads},
+	{Name: "users", Short: "List accounts", Run: cmdUsers},
+	{Name: "user-add", Args: "<name>", Short: "Create an account; the password is read from stdin", Run: cmdUserAdd},
+	{Name: "user-passwd", Args: "<name>", Short: "Change an account's password, signing it out everywhere", Run: cmdUserPasswd},
+	{Name: "user-quota", Args: "<name> <size|default|unlimited>", Short: "Set an account's storage quota, e.g. 10G", Run: cmdUserQuota},
+	{Name: "user-key", Args: "<name> [label]", Short: "Create an API key for an account", Run: cmdUserKey},
+	{Name: "user-delete", Args: "<name>...", Short: "Delete accounts, keeping their shares", Run: cmdUserDelete},
+	{Name: "upload", Args: "<file|->...", Short: "Upload files to a server, resuming interrupted uploads", Remote: true, Run: cmdUpload},
+}
+
+// findCommand returns the subcommand with the given name
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// printUsage lists the subcommands
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: kiss-drop [serve]")
+	fmt.Fprintln(w, "       kiss-drop <command> [--json] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands operate on DATA_DIR and are safe to run while the server is up:")
+	printCommands(w, false)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands that talk to a server ($KISS_DROP_SERVER or --server):")
+	printCommands(w, true)
+}
+
+// printCommands lists the local or remote subcommands
+func printCommands(w io.Writer, remote bool) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		if cmd.Remote == remote {
+			fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.Name, cmd.Args, cmd.Short)
+		}
+	}
+	tw.Flush()
+}
+
+// runCommand runs an admin subcommand and returns the process exit code
+func runCommand(args []string) int {
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "kiss-drop: unknown command %q\n\n", args[0])
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	c := &CLI{cmd: cmd, dataDir: getEnv("DATA_DIR", "./data"), out: os.Stdout}
+	if !cmd.Remote {
+		if _, err := os.Stat(c.dataDir); err != nil {
+			fmt.Fprintf(os.Stderr, "kiss-drop: data directory %s: %v\n", c.dataDir, err)
+			return 1
+		}
+		var err error
+		if c.audit, err = openAuditLog(c.dataDir); err != nil {
+			fmt.Fprintf(os.Stderr, "kiss-drop: %v\n", err)
+			return 1
+		}
+		if c.storage, err = NewStorage(c.dataDir, StorageOptions{Audit: c.audit}); err != nil {
+			fmt.Fprintf(os.Stderr, "kiss-drop: %v\n", err)
+			return 1
+		}
+		if c.uploads, err = NewUploadManager(c.dataDir); err != nil {
+			fmt.Fprintf(os.Stderr, "kiss-drop: %v\n", err)
+			return 1
+		}
+	}
+
+	if err := cmd.Run(c, args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		if errors.Is(err, errUsage) {
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "kiss-drop %s: %v\n", cmd.Name, err)
+		return 1
+	}
+	return 0
+}
+
+// flags returns the flag set of the running command, with --json added
+func (c *CLI) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.cmd.Name, flag.ContinueOnError)
+	fs.BoolVar(&c.json, "json", false, "print JSON instead of a table")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kiss-drop %s [flags] %s\n", c.cmd.Name, c.cmd.Args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses flags that may appear before, between or after positional
+// arguments, and checks the number of positional ones (-1 for any)
+func (c *CLI) parse(fs *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) < minArgs || (maxArgs >= 0 && len(positional) > maxArgs) {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+// printJSON writes v as indented JSON
+func (c *CLI) printJSON(v any) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// table returns a writer that aligns tab-separated columns
+func (c *CLI) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+}
+
+// formatExpiry describes when a share expires
+func formatExpiry(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	s := t.Local().Format("2006-01-02 15:04")
+	if t.Before(time.Now()) {
+		s += " (expired)"
+	}
+	return s
+}
+
+func cmdList(c *CLI, args []string) error {
+	// Flags mirror the GET /api/shares query parameters
+	fs := c.flags()
+	fs.String("q", "", "file name contains")
+	fs.String("type", "", "content type or prefix, e.g. image/")
+	fs.String("status", "", "active, expired or permanent")
+	fs.String("uploader_ip", "", "exact uploader IP")
+	fs.String("owner", "", "owner account ID")
+	fs.String("sort", "", "created (default), name, size or expires")
+	fs.String("order", "", "asc or desc")
+	limit := fs.Int("limit", 0, "show at most this many shares (default all)")
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if *limit < 0 {
+		return fmt.Errorf("invalid limit %d", *limit)
+	}
+
+	// The limit is applied here rather than by the API's capped one, since
+	// the CLI reads every share anyway
+	params := url.Values{}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "json" && f.Name != "limit" {
+			params.Set(f.Name, f.Value.String())
+		}
+	})
+	query, err := ParseShareQuery(params)
+	if err != nil {
+		return err
+	}
+
+	shares, err := c.storage.ListShares(0)
+	if err != nil {
+		return err
+	}
+	query.Limit = *limit
+	if query.Limit == 0 {
+		query.Limit = max(len(shares), 1)
+	}
+	page, _, _ := query.Apply(shares)
+
+	if c.json {
+		return c.printJSON(page)
+	}
+	tw := c.table()
+	fmt.Fprintln(tw, "ID\tFILE\tSIZE\tCREATED\tEXPIRES\tUPLOADER")
+	for _, meta := range page {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", meta.ID, meta.FileName, formatFileSize(meta.FileSize),
+			meta.CreatedAt.Local().Format("2006-01-02 15:04"), formatExpiry(meta.ExpiresAt), meta.UploaderIP)
+	}
+	return tw.Flush()
+}
+
+// getShare loads a share, failing if it doesn't exist
+func (c *CLI) getShare(id string) (*ShareMeta, error) {
+	if !ValidID(id) {
+		return nil, fmt.Errorf("%s: %w", id, ErrInvalidID)
+	}
+	meta, err := c.storage.GetShare(id)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("%s: %w", id, ErrShareNotFound)
+	}
+	return meta, nil
+}
+
+func cmdShow(c *CLI, args []string) error {
+	args, err := c.parse(c.flags(), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	meta, err := c.getShare(args[0])
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(meta)
+	}
+
+	tw := c.table()
+	row := func(label, value string) {
+		if value != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", label, value)
+		}
+	}
+	row("ID", meta.ID)
+	row("File", meta.FileName)
+	row("Size", formatFileSize(meta.FileSize))
+	row("SHA-256", meta.SHA256)
+	row("Type", meta.DetectedType)
+	row("Created", meta.CreatedAt.Local().Format(time.RFC1123))
+	row("Expires", formatExpiry(meta.ExpiresAt))
+	row("Uploader", meta.UploaderIP)
+	row("User agent", meta.UserAgent)
+	row("Request", meta.RequestID)
+	row("Owner", meta.OwnerID)
+	row("Version", strconv.Itoa(meta.CurrentVersion()))
+	row("On disk", formatFileSize(c.storage.ShareDiskUsage(meta.ID)))
+	row("Path", c.storage.GetFilePath(meta.ID, meta.FileName))
+	for i := len(meta.Versions) - 1; i >= 0; i-- {
+		v := meta.Versions[i]
+		row("Version "+strconv.Itoa(v.Version), fmt.Sprintf("%s, %s, %s", v.FileName,
+			formatFileSize(v.FileSize), v.CreatedAt.Local().Format("2006-01-02 15:04")))
+	}
+	return tw.Flush()
+}
+
+func cmdDelete(c *CLI, args []string) error {
+	args, err := c.parse(c.flags(), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	var deleted []string
+	var failed error
+	for _, id := range args {
+		if _, err := c.getShare(id); err != nil {
+			failed = errors.Join(failed, err)
+			continue
+		}
+		if err := c.storage.DeleteShare(id); err != nil {
+			failed = errors.Join(failed, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		c.audit.Record(AuditEvent{Event: AuditDelete, ShareID: id, Actor: ActorCLI})
+		deleted = append(deleted, id)
+	}
+
+	if c.json {
+		if err := c.printJSON(map[string][]string{"deleted": deleted}); err != nil {
+			return err
+		}
+	} else {
+		for _, id := range deleted {
+			fmt.Fprintf(c.out, "Deleted %s\n", id)
+		}
+	}
+	return failed
+}
+
+// parseExtension parses a number of days ("7d") or a Go duration ("12h")
+func parseExtension(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func cmdExtend(c *CLI, args []string) error {
+	args, err := c.parse(c.flags(), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	meta, err := c.getShare(args[0])
+	if err != nil {
+		return err
+	}
+
+	// Extending starts from the current expiry, or from now if that has passed
+	var expiresAt *time.Time
+	if args[1] != "never" {
+		d, err := parseExtension(args[1])
+		if err != nil {
+			return err
+		}
+		if meta.ExpiresAt == nil {
+			return fmt.Errorf("%s never expires", meta.ID)
+		}
+		from := time.Now().UTC()
+		if meta.ExpiresAt.After(from) {
+			from = *meta.ExpiresAt
+		}
+		t := from.Add(d)
+		expiresAt = &t
+	}
+
+	if meta, err = c.storage.SetExpiry(meta.ID, expiresAt); err != nil {
+		return err
+	}
+	c.audit.Record(AuditEvent{Event: AuditExpiry, ShareID: meta.ID, Actor: ActorCLI, Detail: expiryDetail(expiresAt)})
+	if c.json {
+		return c.printJSON(meta)
+	}
+	fmt.Fprintf(c.out, "%s now expires: %s\n", meta.ID, formatExpiry(meta.ExpiresAt))
+	return nil
+}
+
+func cmdCleanup(c *CLI, args []string) error {
+	fs := c.flags()
+	dryRun := fs.Bool("dry-run", false, "only list what would be deleted")
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		expired, err := c.storage.ExpiredShares()
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(expired)
+		}
+		tw := c.table()
+		fmt.Fprintln(tw, "ID\tFILE\tON DISK\tEXPIRED")
+		for _, meta := range expired {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", meta.ID, meta.FileName,
+				formatFileSize(c.storage.ShareDiskUsage(meta.ID)), meta.ExpiresAt.Local().Format("2006-01-02 15:04"))
+		}
+		return tw.Flush()
+	}
+
+	run, err := c.storage.CleanupExpired(CleanupManual)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(run)
+	}
+	fmt.Fprintf(c.out, "Deleted %d expired share(s), freed %s\n", run.Deleted, formatFileSize(run.FreedBytes))
+	return nil
+}
+
+// Stats summarizes the contents of the data directory
+type Stats struct {
+	Shares         int   `json:"shares"`
+	Expired        int   `json:"expired"`
+	Permanent      int   `json:"permanent"`
+	Versions       int   `json:"versions"`
+	FileBytes      int64 `json:"fileBytes"`
+	ShareDiskBytes int64 `json:"shareDiskBytes"`
+	UploadBytes    int64 `json:"uploadBytes"`
+	StaleUploads   int   `json:"staleUploads"`
+	Requests       int   `json:"requests"`
+}
+
+func cmdStats(c *CLI, args []string) error {
+	if _, err := c.parse(c.flags(), args, 0, 0); err != nil {
+		return err
+	}
+	shares, err := c.storage.ListShares(0)
+	if err != nil {
+		return err
+	}
+	stale, err := c.uploads.StaleUploads(uploadTimeout)
+	if err != nil {
+		return err
+	}
+	requests, err := NewRequestStore(c.dataDir)
+	if err != nil {
+		return err
+	}
+	reqs, err := requests.ListRequests()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	stats := Stats{
+		Shares:       len(shares),
+		UploadBytes:  c.uploads.DiskUsage(),
+		StaleUploads: len(stale),
+		Requests:     len(reqs),
+	}
+	for _, meta := range shares {
+		switch {
+		case meta.ExpiresAt == nil:
+			stats.Permanent++
+		case meta.ExpiresAt.Before(now):
+			stats.Expired++
+		}
+		stats.Versions += len(meta.Versions) + 1
+		stats.FileBytes += meta.FileSize
+		stats.ShareDiskBytes += c.storage.ShareDiskUsage(meta.ID)
+	}
+
+	if c.json {
+		return c.printJSON(stats)
+	}
+	tw := c.table()
+	fmt.Fprintf(tw, "Shares:\t%d (%d expired, %d permanent)\n", stats.Shares, stats.Expired, stats.Permanent)
+	fmt.Fprintf(tw, "Versions:\t%d\n", stats.Versions)
+	fmt.Fprintf(tw, "Current files:\t%s\n", formatFileSize(stats.FileBytes))
+	fmt.Fprintf(tw, "Shares on disk:\t%s\n", formatFileSize(stats.ShareDiskBytes))
+	fmt.Fprintf(tw, "Upload chunks:\t%s (%d abandoned upload(s))\n", formatFileSize(stats.UploadBytes), stats.StaleUploads)
+	fmt.Fprintf(tw, "File requests:\t%d\n", stats.Requests)
+	return tw.Flush()
+}
+
+func cmdGCUploads(c *CLI, args []string) error {
+	fs := c.flags()
+	dryRun := fs.Bool("dry-run", false, "only list what would be deleted")
+	idle := fs.Duration("idle", uploadTimeout, fmt.Sprintf("only delete uploads inactive for this long, at least %s;\n"+
+		"the CLI can't see which uploads a running server is still receiving", uploadTimeout))
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if *idle < uploadTimeout {
+		// Chunks only reach disk once written, so a younger upload may
+		// still be in progress on the server
+		return fmt.Errorf("--idle must be at least %s, as the server may still be receiving younger uploads", uploadTimeout)
+	}
+
+	stale, err := c.uploads.StaleUploads(*idle)
+	if err != nil {
+		return err
+	}
+	if !*dryRun {
+		for _, upload := range stale {
+			c.uploads.Cleanup(upload.ID)
+		}
+	}
+
+	if c.json {
+		return c.printJSON(stale)
+	}
+	var total int64
+	for _, upload := range stale {
+		total += upload.Size
+	}
+	verb := "Deleted"
+	if *dryRun {
+		verb = "Would delete"
+	}
+	fmt.Fprintf(c.out, "%s %d abandoned upload(s), %s\n", verb, len(stale), formatFileSize(total))
+	return nil
+}
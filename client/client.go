@@ -0,0 +1,290 @@
+// Package client is a Go client for the kiss-drop HTTP API.
+//
+//	c := client.New("https://drop.example.com")
+//	f, _ := os.Open("report.pdf")
+//	share, err := c.Upload(ctx, f, client.UploadOptions{FileName: "report.pdf"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zackgomez/kiss-drop/api"
+)
+
+// Errors matched by errors.Is against an *Error from the server
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrTooLarge     = errors.New("too large")
+)
+
+// Error is a response from the server with a non-2xx status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("kiss-drop: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("kiss-drop: %s (%d)", e.Message, e.StatusCode)
+}
+
+// Is maps status codes to the Err sentinels, e.g.
+// errors.Is(err, client.ErrNotFound)
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return target == ErrBadRequest
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusRequestEntityTooLarge:
+		return target == ErrTooLarge
+	}
+	return false
+}
+
+// temporary reports whether a request that failed with err may succeed if
+// sent again
+func temporary(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	// Network errors; a cancelled context is not worth retrying
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) &&
+		!errors.Is(err, ErrChanged)
+}
+
+// Client talks to one kiss-drop server. Its fields must not be changed
+// while requests are in flight.
+type Client struct {
+	// BaseURL is the server's root URL, e.g. "https://drop.example.com"
+	BaseURL string
+
+	// Token is sent as a bearer token: the admin token, a personal API
+	// key, or a share's management token. Methods that take a token
+	// override it.
+	Token string
+
+	// HTTPClient sends the requests; nil means http.DefaultClient
+	HTTPClient *http.Client
+
+	// Retries is how many times a failed chunk or download is retried
+	Retries int
+}
+
+// New returns a client for the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Retries: 3,
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// newRequest builds a request for a path on the server. A non-nil body is
+// sent as JSON unless it is an io.Reader.
+func (c *Client) newRequest(ctx context.Context, method, path, token string, body any) (*http.Request, error) {
+	var r io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if token == "" {
+		token = c.Token
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// send sends a request and returns the response, or an *Error if its status
+// isn't 2xx
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// responseError reads the error message from a failed response
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
+
+// call sends a request and decodes the JSON response into out, if not nil
+func (c *Client) call(ctx context.Context, method, path, token string, in, out any) error {
+	req, err := c.newRequest(ctx, method, path, token, in)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("kiss-drop: decoding response: %w", err)
+	}
+	return nil
+}
+
+// sharePath returns the API path of a share
+func sharePath(id string) string {
+	return "/api/share/" + url.PathEscape(id)
+}
+
+// Info returns a share's metadata
+func (c *Client) Info(ctx context.Context, id string) (*api.ShareInfoResponse, error) {
+	var info api.ShareInfoResponse
+	if err := c.call(ctx, http.MethodGet, sharePath(id), "", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Delete removes a share and all its versions. token is the share's
+// management token; "" uses the client's Token.
+func (c *Client) Delete(ctx context.Context, id, token string) error {
+	return c.call(ctx, http.MethodDelete, sharePath(id), token, nil, nil)
+}
+
+// ListOptions filters, orders and pages List. Zero values are left out; see
+// GET /api/shares for the meaning of each.
+type ListOptions struct {
+	Query         string // file name contains
+	ContentType   string // content type or prefix, e.g. "image/"
+	MinSize       int64
+	MaxSize       int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	UploaderIP    string
+	Owner         string // account ID, or "me" for the Token's account
+	Status        string // "active", "expired" or "permanent"
+	Sort          string // "created", "name", "size" or "expires"
+	Order         string // "asc" or "desc"
+	Limit         int
+	Cursor        string // NextCursor of the previous page
+}
+
+// values returns the options as query parameters
+func (o *ListOptions) values() url.Values {
+	q := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	setInt := func(key string, n int64) {
+		if n > 0 {
+			q.Set(key, strconv.FormatInt(n, 10))
+		}
+	}
+	setTime := func(key string, t time.Time) {
+		if !t.IsZero() {
+			q.Set(key, t.Format(time.RFC3339))
+		}
+	}
+	set("q", o.Query)
+	set("type", o.ContentType)
+	setInt("min_size", o.MinSize)
+	setInt("max_size", o.MaxSize)
+	setTime("created_after", o.CreatedAfter)
+	setTime("created_before", o.CreatedBefore)
+	setTime("expires_after", o.ExpiresAfter)
+	setTime("expires_before", o.ExpiresBefore)
+	set("uploader_ip", o.UploaderIP)
+	set("owner", o.Owner)
+	set("status", o.Status)
+	set("sort", o.Sort)
+	set("order", o.Order)
+	setInt("limit", int64(o.Limit))
+	set("cursor", o.Cursor)
+	return q
+}
+
+// List returns one page of shares. Pass the page's NextCursor as
+// opts.Cursor to get the next one.
+func (c *Client) List(ctx context.Context, opts ListOptions) (*api.ShareListResponse, error) {
+	path := "/api/shares"
+	if q := opts.values().Encode(); q != "" {
+		path += "?" + q
+	}
+	var page api.ShareListResponse
+	if err := c.call(ctx, http.MethodGet, path, "", nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// retryDelay is the pause before retry number try
+func retryDelay(try int) time.Duration {
+	return time.Duration(try) * time.Second
+}
+
+// sleep waits for d, returning early if ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
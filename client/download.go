@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrChanged is returned when a share's file is replaced while Download is
+// resuming it
+var ErrChanged = errors.New("kiss-drop: file changed during download")
+
+// DownloadOptions selects what Download fetches
+type DownloadOptions struct {
+	Version int // 0 for the latest
+
+	// Offset skips the start of the file, e.g. to finish a partial download
+	// kept on disk. An offset at or past the end downloads nothing.
+	Offset int64
+
+	// Progress is called as bytes arrive, with the total counted from the
+	// start of the file (-1 if the server didn't say)
+	Progress func(received, total int64)
+}
+
+// Download writes a share's file to w and returns the number of bytes
+// written. If the connection drops, it asks for the rest with a Range
+// request, and fails with ErrChanged if the file was replaced in between.
+func (c *Client) Download(ctx context.Context, id string, w io.Writer, opts DownloadOptions) (int64, error) {
+	path := sharePath(id) + "/download"
+	if opts.Version > 0 {
+		path += "?v=" + strconv.Itoa(opts.Version)
+	}
+
+	var written int64
+	var validator string
+	dst := &trackingWriter{w: w}
+	for try := 0; ; try++ {
+		if try > 0 {
+			if err := sleep(ctx, retryDelay(try)); err != nil {
+				return written, err
+			}
+		}
+
+		n, v, err := c.downloadFrom(ctx, path, opts.Offset+written, validator, dst, &opts)
+		written += n
+		if v != "" {
+			validator = v
+		}
+		if err == nil || dst.err != nil || !temporary(err) || try >= c.Retries {
+			return written, err
+		}
+	}
+}
+
+// downloadFrom sends one download request starting at offset and copies the
+// response to w. It returns the bytes copied and the file's validator, for
+// If-Range on the next attempt.
+func (c *Client) downloadFrom(ctx context.Context, path string, offset int64, validator string, w io.Writer, opts *DownloadOptions) (int64, string, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Del("Accept")
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		if validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+
+	resp, err := c.send(req)
+	var e *Error
+	if errors.As(err, &e) && e.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// Nothing left past offset
+		return 0, validator, nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// If-Range didn't match, so the server sent the whole new file
+		return 0, "", ErrChanged
+	}
+
+	// If-Range needs a strong ETag; fall back to the modification time
+	validator = resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	body := io.Reader(resp.Body)
+	if opts.Progress != nil {
+		body = &progressReader{r: resp.Body, received: offset, total: total, fn: opts.Progress}
+	}
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return n, validator, fmt.Errorf("kiss-drop: download interrupted: %w", err)
+	}
+	return n, validator, nil
+}
+
+// trackingWriter remembers write errors, which unlike read errors are not
+// worth retrying the download for
+type trackingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if err != nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// progressReader reports download progress as the body is read
+type progressReader struct {
+	r        io.Reader
+	received int64
+	total    int64
+	fn       func(received, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.received += int64(n)
+		p.fn(p.received, p.total)
+	}
+	return n, err
+}
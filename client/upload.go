@@ -0,0 +1,357 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zackgomez/kiss-drop/api"
+)
+
+// defaultParallel is the number of chunks sent at once by default
+const defaultParallel = 4
+
+// finalizePoll is how often Upload checks on the server assembling a file
+const finalizePoll = time.Second
+
+// UploadState is the progress of a chunked upload. Saved as JSON, it lets a
+// later Upload of the same data, even from another process, pick up where
+// this one stopped.
+type UploadState struct {
+	UploadID    string    `json:"uploadId"`
+	Size        int64     `json:"size"`
+	ChunkSize   int64     `json:"chunkSize"`
+	Done        []bool    `json:"done"`
+	ManageToken string    `json:"manageToken,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+}
+
+// chunkLen returns the length of chunk i
+func (st *UploadState) chunkLen(i int) int64 {
+	return min(st.ChunkSize, st.Size-int64(i)*st.ChunkSize)
+}
+
+// UploadOptions describes a file for Upload
+type UploadOptions struct {
+	FileName string // required
+
+	// Size is the number of bytes to upload. Zero takes it from the
+	// reader's Size or Stat method, as on *bytes.Reader and *os.File.
+	Size int64
+
+	ExpiresIn    string // days, "default" (or "") or "never"
+	ContentType  string
+	Private      bool   // no link previews
+	KeepMetadata bool   // don't strip photo metadata
+	RequestID    string // upload into a file request
+	ShareID      string // upload a new version of a share; needs its management token as the Token
+
+	// Parallel is the number of chunks sent at once (default 4). Only
+	// readers that are also an io.ReaderAt are sent in parallel.
+	Parallel int
+
+	// State resumes an earlier upload when its UploadID is set. Upload
+	// fills it in as the upload goes and calls SaveState after every change.
+	State     *UploadState
+	SaveState func(*UploadState)
+
+	// Progress is called as bytes are sent, one call at a time
+	Progress func(sent, total int64)
+}
+
+// UploadResult is a share created by Upload
+type UploadResult struct {
+	ID          string
+	URL         string
+	ManageToken string // empty for new versions of an existing share
+}
+
+// Upload sends r to the server in chunks and returns the new share. Chunks
+// that fail are retried, and an interrupted upload can be resumed with
+// opts.State. If the server has forgotten a resumed upload, e.g. because it
+// restarted, Upload starts over when r is an io.ReaderAt and fails with
+// ErrNotFound otherwise.
+func (c *Client) Upload(ctx context.Context, r io.Reader, opts UploadOptions) (*UploadResult, error) {
+	if opts.FileName == "" {
+		return nil, errors.New("kiss-drop: FileName is required")
+	}
+	size := opts.Size
+	if size == 0 {
+		var ok bool
+		if size, ok = readerSize(r); !ok {
+			return nil, errors.New("kiss-drop: Size is required for this reader")
+		}
+	}
+	if size <= 0 {
+		return nil, errors.New("kiss-drop: can't upload an empty file")
+	}
+
+	st := opts.State
+	if st == nil {
+		st = &UploadState{}
+	}
+	if st.UploadID != "" && st.Size != size {
+		return nil, fmt.Errorf("kiss-drop: resumed upload has %d bytes, not %d", st.Size, size)
+	}
+
+	u := &uploader{c: c, opts: &opts, st: st}
+	at, random := randomAccess(r)
+	for attempt := 0; ; attempt++ {
+		resumed := st.UploadID != ""
+		if !resumed {
+			if err := u.init(ctx, size); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		if random {
+			err = u.sendParallel(ctx, at)
+		} else {
+			err = u.sendSequential(ctx, r)
+		}
+		var result *UploadResult
+		if err == nil {
+			result, err = u.complete(ctx)
+		}
+		if resumed && random && attempt == 0 && errors.Is(err, ErrNotFound) {
+			*st = UploadState{}
+			u.sent = 0
+			continue
+		}
+		return result, err
+	}
+}
+
+// readerSize returns the size of r, if it can tell
+func readerSize(r io.Reader) (int64, bool) {
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		return v.Size(), true
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := v.Stat()
+		if err == nil && info.Mode().IsRegular() {
+			return info.Size(), true
+		}
+	}
+	return 0, false
+}
+
+// randomAccess returns r as an io.ReaderAt if chunks can be read from it
+// in any order. Files only qualify if they are regular, not pipes.
+func randomAccess(r io.Reader) (io.ReaderAt, bool) {
+	at, ok := r.(io.ReaderAt)
+	if f, isFile := r.(*os.File); isFile {
+		info, err := f.Stat()
+		ok = err == nil && info.Mode().IsRegular()
+	}
+	return at, ok
+}
+
+// uploader holds the state of one Upload call
+type uploader struct {
+	c    *Client
+	opts *UploadOptions
+	st   *UploadState
+
+	mu   sync.Mutex // guards st.Done and sent
+	sent int64
+}
+
+// save reports a change of state to the caller
+func (u *uploader) save() {
+	if u.opts.SaveState != nil {
+		u.opts.SaveState(u.st)
+	}
+}
+
+// addSent adds n sent bytes (negative when a chunk has to be sent again)
+func (u *uploader) addSent(n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sent += n
+	if u.opts.Progress != nil {
+		u.opts.Progress(u.sent, u.st.Size)
+	}
+}
+
+// init starts a new upload session
+func (u *uploader) init(ctx context.Context, size int64) error {
+	req := api.InitUploadRequest{
+		FileName:     u.opts.FileName,
+		FileSize:     size,
+		ExpiresIn:    u.opts.ExpiresIn,
+		ContentType:  u.opts.ContentType,
+		RequestID:    u.opts.RequestID,
+		ShareID:      u.opts.ShareID,
+		KeepMetadata: u.opts.KeepMetadata,
+		Private:      u.opts.Private,
+	}
+	var resp api.InitUploadResponse
+	if err := u.c.call(ctx, http.MethodPost, "/api/upload/init", "", req, &resp); err != nil {
+		return err
+	}
+	*u.st = UploadState{
+		UploadID:    resp.UploadID,
+		Size:        size,
+		ChunkSize:   resp.ChunkSize,
+		Done:        make([]bool, resp.TotalChunks),
+		ManageToken: resp.ManageToken,
+		StartedAt:   time.Now(),
+	}
+	u.save()
+	return nil
+}
+
+// sendSequential sends the chunks of a reader that can only be read in
+// order, skipping the ones already on the server
+func (u *uploader) sendSequential(ctx context.Context, r io.Reader) error {
+	buf := make([]byte, u.st.ChunkSize)
+	for i, done := range u.st.Done {
+		n := u.st.chunkLen(i)
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return fmt.Errorf("kiss-drop: reading chunk %d: %w", i, err)
+		}
+		if done {
+			u.addSent(n)
+			continue
+		}
+		if err := u.sendChunk(ctx, i, io.NewSectionReader(bytes.NewReader(buf[:n]), 0, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendParallel sends the missing chunks of a random-access reader with
+// several requests at once
+func (u *uploader) sendParallel(ctx context.Context, r io.ReaderAt) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+		for i, done := range u.st.Done {
+			if done {
+				u.addSent(u.st.chunkLen(i))
+				continue
+			}
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	parallel := u.opts.Parallel
+	if parallel <= 0 {
+		parallel = defaultParallel
+	}
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for range parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				chunk := io.NewSectionReader(r, int64(i)*u.st.ChunkSize, u.st.chunkLen(i))
+				if err := u.sendChunk(ctx, i, chunk); err != nil {
+					once.Do(func() { firstErr = err })
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// sendChunk uploads chunk i, retrying temporary failures, and marks it done
+func (u *uploader) sendChunk(ctx context.Context, i int, chunk *io.SectionReader) error {
+	path := "/api/upload/" + u.st.UploadID + "/chunk/" + strconv.Itoa(i)
+	var err error
+	for try := 0; try <= u.c.Retries; try++ {
+		if try > 0 {
+			if err := sleep(ctx, retryDelay(try)); err != nil {
+				return err
+			}
+		}
+
+		body := &countingReader{r: io.NewSectionReader(chunk, 0, chunk.Size()), u: u}
+		var req *http.Request
+		if req, err = u.c.newRequest(ctx, http.MethodPost, path, "", body); err != nil {
+			return err
+		}
+		req.ContentLength = chunk.Size()
+
+		var resp *http.Response
+		if resp, err = u.c.send(req); err == nil {
+			resp.Body.Close()
+			u.mu.Lock()
+			u.st.Done[i] = true
+			u.save()
+			u.mu.Unlock()
+			return nil
+		}
+		// The chunk will be sent again in full
+		u.addSent(-body.n)
+		if !temporary(err) {
+			break
+		}
+	}
+	return fmt.Errorf("kiss-drop: sending chunk %d: %w", i, err)
+}
+
+// countingReader adds the bytes of a chunk to the upload's progress as they
+// are sent
+type countingReader struct {
+	r io.Reader
+	u *uploader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.n += int64(n)
+		c.u.addSent(int64(n))
+	}
+	return n, err
+}
+
+// complete asks the server to assemble the chunks and waits until the share
+// is ready
+func (u *uploader) complete(ctx context.Context) (*UploadResult, error) {
+	var job api.FinalizeStatusResponse
+	path := "/api/upload/" + u.st.UploadID + "/complete"
+	if err := u.c.call(ctx, http.MethodPost, path, "", nil, &job); err != nil {
+		return nil, err
+	}
+
+	for job.Status == api.JobRunning {
+		if err := sleep(ctx, finalizePoll); err != nil {
+			return nil, err
+		}
+		if err := u.c.call(ctx, http.MethodGet, job.StatusURL, "", nil, &job); err != nil {
+			return nil, err
+		}
+	}
+	if job.Status != api.JobDone {
+		return nil, fmt.Errorf("kiss-drop: server failed to assemble upload: %s", job.Error)
+	}
+	return &UploadResult{ID: job.ID, URL: job.URL, ManageToken: u.st.ManageToken}, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zackgomez/kiss-drop/api"
+)
+
+// ErrUploadFinalizing is returned when a chunk arrives after completion has started
+var ErrUploadFinalizing = errors.New("upload is being finalized")
+
+// FinalizeJob tracks the background assembly of a chunked upload into a share
+type FinalizeJob struct {
+	ID         string
+	UploadID   string
+	OwnerID    string // the account that started the upload, if any
+	TotalBytes int64
+	StartedAt  time.Time
+
+	bytesProcessed atomic.Int64
+
+	mu         sync.Mutex
+	status     string
+	shareID    string
+	errMsg     string
+	finishedAt time.Time
+}
+
+// finish records the outcome of a job
+func (j *FinalizeJob) finish(shareID string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishedAt = time.Now()
+	if err != nil {
+		j.status = api.JobFailed
+		j.errMsg = err.Error()
+		return
+	}
+	j.status = api.JobDone
+	j.shareID = shareID
+}
+
+// Status returns the job's current state and, once finished, its share ID or error
+func (j *FinalizeJob) Status() (status, shareID, errMsg string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status, j.shareID, j.errMsg
+}
+
+// finishedBefore reports whether the job finished before the given time
+func (j *FinalizeJob) finishedBefore(t time.Time) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status != api.JobRunning && j.finishedAt.Before(t)
+}
+
+// StartFinalize marks a complete upload session as finalizing and returns a
+// new job for it, along with the session to run it on. If a job already
+// exists for the upload it is returned instead, so that retried completions
+// are idempotent; started reports whether the caller is responsible for
+// running the new job.
+func (um *UploadManager) StartFinalize(uploadID string) (job *FinalizeJob, session *UploadSession, started bool, err error) {
+	um.mu.RLock()
+	job, session = um.jobs[uploadID], um.sessions[uploadID]
+	um.mu.RUnlock()
+	if job != nil {
+		return job, nil, false, nil
+	}
+	if session == nil {
+		return nil, nil, false, nil
+	}
+
+	// A chunk being written holds the session's lock, so wait for it
+	// without holding um.mu
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	for _, received := range session.ReceivedMask {
+		if !received {
+			return nil, nil, false, fmt.Errorf("upload not complete")
+		}
+	}
+
+	id, err := GenerateID()
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("generating job ID: %w", err)
+	}
+
+	// Another completion may have won the race, or the session may have
+	// been cleaned up meanwhile
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if job := um.jobs[uploadID]; job != nil {
+		return job, nil, false, nil
+	}
+	if um.sessions[uploadID] != session {
+		return nil, nil, false, nil
+	}
+
+	session.Finalizing = true
+	job = &FinalizeJob{
+		ID:         id,
+		UploadID:   uploadID,
+		OwnerID:    session.OwnerID,
+		TotalBytes: session.FileSize,
+		StartedAt:  time.Now(),
+		status:     api.JobRunning,
+	}
+	um.jobs[uploadID] = job
+	return job, session, true, nil
+}
+
+// GetJob returns the finalize job for an upload, if any
+func (um *UploadManager) GetJob(uploadID string) *FinalizeJob {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	return um.jobs[uploadID]
+}
+
+// VerifyChunks checks that every chunk on disk has the expected size
+func (um *UploadManager) VerifyChunks(session *UploadSession) error {
+	for i := 0; i < session.TotalChunks; i++ {
+		expected := session.ChunkSize
+		if i == session.TotalChunks-1 {
+			expected = session.FileSize - int64(i)*session.ChunkSize
+		}
+		size, err := um.chunkSize(session.ID, i)
+		if err != nil {
+			return fmt.Errorf("checking chunk %d: %w", i, err)
+		}
+		if size != expected {
+			return fmt.Errorf("chunk %d is %d bytes, expected %d", i, size, expected)
+		}
+	}
+	return nil
+}
+
+// progressReader counts bytes read into a finalize job
+type progressReader struct {
+	r   io.Reader
+	job *FinalizeJob
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.job.bytesProcessed.Add(int64(n))
+	return n, err
+}
+
+// runFinalize assembles an upload's chunks into a share. It runs in the
+// background so that multi-GB uploads don't hold the complete request open.
+func (h *Handlers) runFinalize(job *FinalizeJob, session *UploadSession) {
+	meta, err := h.finalizeUpload(job, session)
+	if err != nil {
+		log.Printf("Error finalizing upload %s: %v", session.ID, err)
+		job.finish("", err)
+	} else {
+		job.finish(meta.ID, nil)
+		event := AuditShareCreated
+		if session.ShareID != "" {
+			event = AuditVersionAdded
+		}
+		h.auditLog.Record(AuditEvent{
+			Event:     event,
+			ShareID:   meta.ID,
+			UploadID:  session.ID,
+			Version:   meta.CurrentVersion(),
+			Actor:     session.Actor,
+			ClientIP:  session.UploaderIP,
+			UserAgent: session.UserAgent,
+			FileName:  meta.FileName,
+			Bytes:     meta.FileSize,
+		})
+	}
+
+	// Chunks are no longer needed either way; the job keeps the result
+	h.uploads.Cleanup(session.ID)
+}
+
+// finalizeUpload verifies and copies all chunks of a session into a new share
+func (h *Handlers) finalizeUpload(job *FinalizeJob, session *UploadSession) (*ShareMeta, error) {
+	if err := h.uploads.VerifyChunks(session); err != nil {
+		return nil, err
+	}
+
+	reader := &progressReader{
+		r: &chunkReader{
+			um:       h.uploads,
+			uploadID: session.ID,
+			session:  session,
+		},
+		job: job,
+	}
+
+	// Use upload info from session
+	info := &UploadInfo{
+		UploaderIP:      session.UploaderIP,
+		UserAgent:       session.UserAgent,
+		ContentType:     session.ContentType,
+		RequestID:       session.RequestID,
+		ManageTokenHash: session.ManageTokenHash,
+		KeepMetadata:    session.KeepMetadata,
+		Slug:            session.Slug,
+		Private:         session.Private,
+		OwnerID:         session.OwnerID,
+	}
+
+	if session.ShareID != "" {
+		meta, err := h.storage.AddVersion(session.ShareID, reader, session.FileName, info)
+		if err != nil {
+			return nil, fmt.Errorf("adding version: %w", err)
+		}
+		return meta, nil
+	}
+
+	meta, err := h.storage.CreateShare(reader, session.FileName, session.FileSize, h.expiresAt(session.ExpiresIn), info)
+	if err != nil {
+		return nil, fmt.Errorf("creating share: %w", err)
+	}
+	// The stored size may differ if metadata was stripped, so check what was read
+	if assembled := job.bytesProcessed.Load(); assembled != session.FileSize {
+		h.storage.DeleteShare(meta.ID)
+		return nil, fmt.Errorf("assembled %d bytes, expected %d", assembled, session.FileSize)
+	}
+
+	if session.RequestID != "" {
+		if err := h.linkRequestShare(meta); err != nil {
+			return nil, err
+		}
+	}
+
+	return meta, nil
+}
+
+// jobResponse converts a finalize job to its response format
+func (h *Handlers) jobResponse(job *FinalizeJob) api.FinalizeStatusResponse {
+	status, shareID, errMsg := job.Status()
+	resp := api.FinalizeStatusResponse{
+		JobID:          job.ID,
+		UploadID:       job.UploadID,
+		Status:         status,
+		BytesProcessed: job.bytesProcessed.Load(),
+		TotalBytes:     job.TotalBytes,
+		StatusURL:      "/api/upload/" + job.UploadID + "/status",
+		Error:          errMsg,
+	}
+	if shareID != "" {
+		resp.ID = shareID
+		resp.URL = h.shareURL(shareID)
+	}
+	return resp
+}
+
+// writeJob writes a job's status, using 202 Accepted while it is still running
+func (h *Handlers) writeJob(w http.ResponseWriter, job *FinalizeJob) {
+	resp := h.jobResponse(job)
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status == api.JobRunning {
+		w.Header().Set("Location", resp.StatusURL)
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleUploadStatus handles GET /api/upload/:uploadId/status
+func (h *Handlers) HandleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/upload/")
+	uploadID := strings.TrimSuffix(path, "/status")
+
+	job := h.uploads.GetJob(uploadID)
+	if job == nil {
+		http.Error(w, "Finalize job not found", http.StatusNotFound)
+		return
+	}
+	if !h.checkUploadOwner(w, r, job.OwnerID) {
+		return
+	}
+
+	resp := h.jobResponse(job)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zackgomez/kiss-drop/api"
+)
+
+// newTestHandlers returns handlers over empty storage in a temporary directory
+func newTestHandlers(t *testing.T) *Handlers {
+	t.Helper()
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := NewUploadManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, err := NewRequestStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHandlers(storage, uploads, requests, HandlerOptions{})
+}
+
+func TestFinalize(t *testing.T) {
+	h := newTestHandlers(t)
+	const content = "hello, chunked world"
+
+	w := httptest.NewRecorder()
+	h.HandleUploadInit(w, httptest.NewRequest("POST", "/api/upload/init",
+		strings.NewReader(`{"fileName":"hello.txt","fileSize":20}`)))
+	var init api.InitUploadResponse
+	if err := json.NewDecoder(w.Body).Decode(&init); err != nil || init.TotalChunks != 1 {
+		t.Fatalf("init: status %d, %+v, %v", w.Code, init, err)
+	}
+	base := "/api/upload/" + init.UploadID
+
+	type step struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		path    string
+		body    string
+		want    int
+		status  string // the job's, if the response is one
+	}
+	run := func(t *testing.T, steps []step) (job api.FinalizeStatusResponse) {
+		t.Helper()
+		for _, s := range steps {
+			w := httptest.NewRecorder()
+			s.handler(w, httptest.NewRequest(s.method, base+s.path, strings.NewReader(s.body)))
+			if w.Code != s.want {
+				t.Fatalf("%s: status %d, want %d: %s", s.name, w.Code, s.want, w.Body)
+			}
+			if s.status == "" {
+				continue
+			}
+			var resp api.FinalizeStatusResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("%s: %v", s.name, err)
+			}
+			if resp.Status != s.status {
+				t.Fatalf("%s: job %s, want %s", s.name, resp.Status, s.status)
+			}
+			if job.JobID != "" && resp.JobID != job.JobID {
+				t.Fatalf("%s: job %s, want the earlier %s", s.name, resp.JobID, job.JobID)
+			}
+			job = resp
+		}
+		return job
+	}
+
+	run(t, []step{
+		{"complete too early", h.HandleUploadComplete, "POST", "/complete", "", 400, ""},
+		{"status before completing", h.HandleUploadStatus, "GET", "/status", "", 404, ""},
+		{"chunk", h.HandleUploadChunk, "POST", "/chunk/0", content, 200, ""},
+	})
+
+	// Start the job without running it, so it stays in progress
+	job, session, started, err := h.uploads.StartFinalize(init.UploadID)
+	if err != nil || !started {
+		t.Fatalf("StartFinalize: started %t, %v", started, err)
+	}
+	running := run(t, []step{
+		{"chunk while finalizing", h.HandleUploadChunk, "POST", "/chunk/0", content, 409, ""},
+		{"retried complete", h.HandleUploadComplete, "POST", "/complete", "", 202, api.JobRunning},
+		{"status while running", h.HandleUploadStatus, "GET", "/status", "", 200, api.JobRunning},
+		{"status by POST", h.HandleUploadStatus, "POST", "/status", "", 405, ""},
+	})
+	if running.JobID != job.ID {
+		t.Fatalf("retried complete returned job %s, want %s", running.JobID, job.ID)
+	}
+	if again, _, started, _ := h.uploads.StartFinalize(init.UploadID); again != job || started {
+		t.Fatal("a retried completion started another job")
+	}
+
+	h.runFinalize(job, session)
+	done := run(t, []step{
+		{"status when done", h.HandleUploadStatus, "GET", "/status", "", 200, api.JobDone},
+		{"complete when done", h.HandleUploadComplete, "POST", "/complete", "", 200, api.JobDone},
+		{"chunk when done", h.HandleUploadChunk, "POST", "/chunk/0", content, 404, ""},
+	})
+
+	meta, err := h.storage.GetShare(done.ID)
+	if err != nil || meta == nil {
+		t.Fatalf("share %q: %v", done.ID, err)
+	}
+	if meta.FileName != "hello.txt" || meta.FileSize != int64(len(content)) {
+		t.Errorf("share is %s of %d bytes", meta.FileName, meta.FileSize)
+	}
+	if done.BytesProcessed != done.TotalBytes {
+		t.Errorf("processed %d of %d bytes", done.BytesProcessed, done.TotalBytes)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockDir only checks that the directory exists; without flock, updates are
+// serialized within the process alone
+func lockDir(dir string) (func(), error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
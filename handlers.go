@@ -1,54 +1,374 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/zackgomez/kiss-drop/api"
 )
 
 // Handlers holds HTTP handlers and their dependencies
 type Handlers struct {
-	storage       *Storage
-	uploads       *UploadManager
-	baseURL       string
-	defaultExpiry time.Duration
+	storage         *Storage
+	uploads         *UploadManager
+	requests        *RequestStore
+	baseURL         string
+	defaultExpiry   time.Duration
+	adminToken      string
+	downloadLimit   *Throttle
+	uploadLimit     *Throttle
+	signingSecret   []byte
+	unfurl          string
+	users           *UserStore
+	trustedProxies  IPSet
+	proxyHeader     string
+	forwardAuth     *ForwardAuth
+	loginToUpload   bool
+	loginToDownload bool
+	defaultQuota    int64
+	notFoundLimit   *RequestLimit
+	auditLog        *AuditLog
+}
+
+// HandlerOptions configures Handlers
+type HandlerOptions struct {
+	BaseURL       string
+	DefaultExpiry time.Duration
+	// AdminToken enables the admin APIs when set
+	AdminToken    string
+	DownloadLimit *Throttle
+	UploadLimit   *Throttle
+	// SigningSecret keys signed download links; minting is disabled when empty
+	SigningSecret string
+	// Unfurl sets how much link previews reveal (UnfurlFull when empty)
+	Unfurl string
+	// Users enables accounts when set
+	Users *UserStore
+	// TrustedProxies may set forwarding headers for the client IP
+	TrustedProxies IPSet
+	// ProxyHeader is the one forwarding header they set (X-Forwarded-For
+	// when empty)
+	ProxyHeader string
+	// ForwardAuth signs in users named by a trusted reverse proxy
+	ForwardAuth *ForwardAuth
+	// LoginToUpload turns off anonymous uploads, except into file requests
+	LoginToUpload bool
+	// LoginToDownload turns off anonymous downloads, except with signed links
+	LoginToDownload bool
+	// DefaultQuota limits the storage of each account (0 = unlimited)
+	DefaultQuota int64
+	// NotFoundLimit caps the 404s each client IP may get, to slow down
+	// guessing share IDs
+	NotFoundLimit *RequestLimit
+	// Audit records who uploaded, downloaded and deleted shares
+	Audit *AuditLog
 }
 
 // NewHandlers creates a new Handlers instance
-func NewHandlers(storage *Storage, uploads *UploadManager, baseURL string, defaultExpiry time.Duration) *Handlers {
+func NewHandlers(storage *Storage, uploads *UploadManager, requests *RequestStore, opts HandlerOptions) *Handlers {
+	unfurl := opts.Unfurl
+	if unfurl == "" {
+		unfurl = UnfurlFull
+	}
+	proxyHeader := opts.ProxyHeader
+	if proxyHeader == "" {
+		proxyHeader = ProxyHeaderXForwardedFor
+	}
 	return &Handlers{
-		storage:       storage,
-		uploads:       uploads,
-		baseURL:       strings.TrimSuffix(baseURL, "/"),
-		defaultExpiry: defaultExpiry,
+		storage:         storage,
+		uploads:         uploads,
+		requests:        requests,
+		baseURL:         strings.TrimSuffix(opts.BaseURL, "/"),
+		defaultExpiry:   opts.DefaultExpiry,
+		adminToken:      opts.AdminToken,
+		downloadLimit:   opts.DownloadLimit,
+		uploadLimit:     opts.UploadLimit,
+		signingSecret:   []byte(opts.SigningSecret),
+		unfurl:          unfurl,
+		users:           opts.Users,
+		trustedProxies:  opts.TrustedProxies,
+		proxyHeader:     proxyHeader,
+		forwardAuth:     opts.ForwardAuth,
+		loginToUpload:   opts.LoginToUpload,
+		loginToDownload: opts.LoginToDownload,
+		defaultQuota:    opts.DefaultQuota,
+		notFoundLimit:   opts.NotFoundLimit,
+		auditLog:        opts.Audit,
+	}
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// currentUser returns the signed-in account, from a personal API key, a
+// trusted proxy's forward auth header or the session cookie, or nil if
+// there is none or accounts are disabled
+func (h *Handlers) currentUser(r *http.Request) *User {
+	if h.users == nil {
+		return nil
+	}
+	var user *User
+	var err error
+	if token := bearerToken(r); strings.HasPrefix(token, apiKeyPrefix) {
+		user, err = h.users.UserForAPIKey(token)
+	} else if h.forwardAuth != nil && h.forwardAuth.identity(r) != "" {
+		user, err = h.forwardAuth.User(r)
+	} else if cookie, cerr := r.Cookie(sessionCookie); cerr == nil {
+		user, err = h.users.SessionUser(cookie.Value)
+	}
+	if err != nil {
+		log.Printf("Error looking up user: %v", err)
+	}
+	return user
+}
+
+// hasAdminToken reports whether the request carries the admin token, as a
+// bearer token or as the password of HTTP basic auth, which is how browsers
+// sign in to the dashboard
+func (h *Handlers) hasAdminToken(r *http.Request) bool {
+	token := bearerToken(r)
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return h.adminToken != "" && token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) == 1
+}
+
+// isAdmin reports whether the request carries the admin token or comes
+// from an admin account. Every admin check goes through it, so the same
+// credentials work on every route.
+func (h *Handlers) isAdmin(r *http.Request) bool {
+	if h.hasAdminToken(r) {
+		return true
+	}
+	user := h.currentUser(r)
+	return user != nil && user.Admin
+}
+
+// adminEnabled reports whether anyone can be an admin
+func (h *Handlers) adminEnabled() bool {
+	return h.adminToken != "" || h.users != nil
+}
+
+// requireAdmin checks for admin credentials, writing an error if missing
+func (h *Handlers) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !h.adminEnabled() {
+		http.Error(w, "Admin API disabled", http.StatusForbidden)
+		return false
+	}
+	if !h.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// canManage reports whether the request may modify a share: with the
+// share's management token, as its owner, or as an admin
+func (h *Handlers) canManage(r *http.Request, meta *ShareMeta) bool {
+	if h.isAdmin(r) {
+		return true
+	}
+	if meta.OwnerID != "" {
+		if user := h.currentUser(r); user != nil && user.ID == meta.OwnerID {
+			return true
+		}
+	}
+	token := bearerToken(r)
+	if token == "" || meta.ManageTokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(meta.ManageTokenHash)) == 1
+}
+
+// checkUploader decides whether the requester may upload size more bytes,
+// writing an error if not. Anonymous uploads are turned off by
+// LoginToUpload, except into file requests, whose links grant access on
+// their own. Accounts are held to their quota.
+func (h *Handlers) checkUploader(w http.ResponseWriter, r *http.Request, user *User, requestID string, size int64) bool {
+	if user == nil {
+		if h.loginToUpload && requestID == "" && !h.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Sign in to upload", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	return h.checkQuota(w, user, "your", size)
+}
+
+// checkVersionQuota checks a new version of a share against the quota of
+// the share's owner, who is charged for it whoever uploads it. Shares
+// without an owner have no quota.
+func (h *Handlers) checkVersionQuota(w http.ResponseWriter, id string, size int64) bool {
+	meta, err := h.storage.GetShare(id)
+	if err != nil {
+		log.Printf("Error getting share: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	if meta == nil {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return false
+	}
+	if meta.OwnerID == "" || h.users == nil {
+		return true
+	}
+	owner, err := h.users.GetUser(meta.OwnerID)
+	if err != nil {
+		log.Printf("Error getting owner of %s: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	if owner == nil {
+		return true
+	}
+	return h.checkQuota(w, owner, "the share owner's", size)
+}
+
+// checkQuota decides whether size more bytes fit in an account's quota,
+// writing an error naming whose quota it is if not. A size of -1 (a body
+// without Content-Length) is refused when there is a quota.
+func (h *Handlers) checkQuota(w http.ResponseWriter, user *User, whose string, size int64) bool {
+	quota := user.QuotaFor(h.defaultQuota)
+	if quota == 0 {
+		return true
+	}
+	if size < 0 {
+		http.Error(w, "Content-Length required", http.StatusLengthRequired)
+		return false
+	}
+	used, err := h.storage.OwnerUsage(user.ID)
+	if err != nil {
+		log.Printf("Error computing usage for %s: %v", user.Name, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	// Count unfinished uploads too, so parallel ones can't overshoot
+	if used+h.uploads.PendingBytes(user.ID)+size > quota {
+		http.Error(w, fmt.Sprintf("Upload exceeds %s quota (%s of %s used)",
+			whose, formatFileSize(used), formatFileSize(quota)), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// downloadAllowed reports whether the requester may see shares under
+// LoginToDownload
+func (h *Handlers) downloadAllowed(r *http.Request) bool {
+	return !h.loginToDownload || h.currentUser(r) != nil || h.isAdmin(r)
+}
+
+// checkDownloader writes an error for anonymous requests when downloading
+// requires signing in
+func (h *Handlers) checkDownloader(w http.ResponseWriter, r *http.Request) bool {
+	if h.downloadAllowed(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Sign in to download", http.StatusUnauthorized)
+	return false
+}
+
+// checkUploadOwner verifies that an upload started by an account, with the
+// given owner ID, is only continued or looked up by that account, writing an
+// error if not
+func (h *Handlers) checkUploadOwner(w http.ResponseWriter, r *http.Request, ownerID string) bool {
+	if ownerID == "" {
+		return true
+	}
+	if user := h.currentUser(r); user == nil || user.ID != ownerID {
+		http.Error(w, "Upload belongs to another account", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkSlug validates a requested vanity share ID, which only admins may
+// choose, writing an error if it can't be used
+func (h *Handlers) checkSlug(w http.ResponseWriter, r *http.Request, slug string) bool {
+	if slug == "" {
+		return true
 	}
+	if !h.isAdmin(r) {
+		http.Error(w, "Only admins can choose a share ID", http.StatusForbidden)
+		return false
+	}
+	if err := ValidateSlug(slug); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if h.storage.ShareExists(slug) {
+		http.Error(w, ErrIDTaken.Error(), http.StatusConflict)
+		return false
+	}
+	return true
 }
 
-// getClientIP extracts the client IP from the request, preferring X-Forwarded-For
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (may contain comma-separated list)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first IP in the list (original client)
-		if idx := strings.Index(xff, ","); idx != -1 {
-			return strings.TrimSpace(xff[:idx])
+// expiresAt converts an expires_in value (days, "default" or "never") to an expiry time
+func (h *Handlers) expiresAt(expiresIn string) *time.Time {
+	if expiresIn == "" || expiresIn == "default" {
+		if h.defaultExpiry > 0 {
+			t := time.Now().Add(h.defaultExpiry)
+			return &t
 		}
-		return strings.TrimSpace(xff)
+		return nil
+	}
+	// "never" (or anything unparseable) means no expiration
+	days, err := strconv.Atoi(expiresIn)
+	if err == nil && days > 0 {
+		t := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+		return &t
 	}
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+	return nil
+}
+
+// shareURL returns the public link for a share
+func (h *Handlers) shareURL(id string) string {
+	return h.baseURL + "/s/" + id
+}
+
+// directURL returns a download link ending in the file's name
+func (h *Handlers) directURL(id, fileName string) string {
+	return h.baseURL + "/d/" + id + "/" + url.PathEscape(fileName)
+}
+
+// wantsPlainText reports whether an API response should be plain text
+// rather than JSON: when asked for, or for curl and wget unless they ask
+// for JSON
+func wantsPlainText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") {
+		return false
 	}
-	// Fall back to RemoteAddr (strip port)
-	ip := r.RemoteAddr
-	if idx := strings.LastIndex(ip, ":"); idx != -1 {
-		return ip[:idx]
+	if strings.Contains(accept, "text/plain") {
+		return true
 	}
-	return ip
+	ua := strings.ToLower(r.UserAgent())
+	return strings.HasPrefix(ua, "curl/") || strings.HasPrefix(ua, "wget/")
+}
+
+// clientIP returns the address of the client, looking past trusted proxies
+func (h *Handlers) clientIP(r *http.Request) string {
+	return clientIP(r, h.trustedProxies, h.proxyHeader)
 }
 
 // sanitizeFileName cleans up a filename for safe storage
@@ -70,6 +390,11 @@ func sanitizeFileName(name string) string {
 		name = "file"
 	}
 
+	// Avoid clobbering files kiss-drop keeps next to the upload
+	if IsReservedName(name) {
+		name = "_" + name
+	}
+
 	return name
 }
 
@@ -80,6 +405,15 @@ func (h *Handlers) HandleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check before reading the body; the request ID has to be in the URL
+	// for anonymous uploads into file requests when sign-in is required
+	user := h.currentUser(r)
+	if !h.checkUploader(w, r, user, r.URL.Query().Get("request_id"), r.ContentLength) {
+		return
+	}
+
+	r.Body = h.uploadLimit.Body(r)
+
 	// Parse multipart form (max 10GB)
 	if err := r.ParseMultipartForm(10 << 30); err != nil {
 		log.Printf("Error parsing form: %v", err)
@@ -95,69 +429,116 @@ func (h *Handlers) HandleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
+	// Content-Length covers the whole form, and may be missing, so check
+	// the quota again against the file part itself
+	requestID := r.FormValue("request_id")
+	if !h.checkUploader(w, r, user, requestID, header.Size) {
+		return
+	}
+
 	fileName := sanitizeFileName(header.Filename)
 
-	// Handle expiration
-	var expiresAt *time.Time
-	expiresInStr := r.FormValue("expires_in")
-	if expiresInStr == "" || expiresInStr == "default" {
-		// Use default expiry
-		if h.defaultExpiry > 0 {
-			t := time.Now().Add(h.defaultExpiry)
-			expiresAt = &t
-		}
-	} else if expiresInStr != "never" {
-		// Parse as days
-		days, err := strconv.Atoi(expiresInStr)
-		if err == nil && days > 0 {
-			t := time.Now().Add(time.Duration(days) * 24 * time.Hour)
-			expiresAt = &t
-		}
+	// Uploads through a file request get the defaults, not options of
+	// the uploader's choosing
+	expiresIn, private, slug := r.FormValue("expires_in"), r.FormValue("private") == "true", r.FormValue("slug")
+	if requestID != "" {
+		expiresIn, private, slug = "", false, ""
+	}
+	expiresAt := h.expiresAt(expiresIn)
+
+	if !h.checkSlug(w, r, slug) {
+		return
+	}
+
+	// Uploads through a file request must fit within its limits
+	if requestID != "" && !h.checkRequestUpload(w, requestID, fileName, header.Size) {
+		return
+	}
+
+	manageToken, err := GenerateToken()
+	if err != nil {
+		log.Printf("Error generating token: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
 	}
-	// "never" means no expiration (expiresAt stays nil)
 
 	// Capture upload metadata
 	info := &UploadInfo{
-		UploaderIP:  getClientIP(r),
-		UserAgent:   r.UserAgent(),
-		ContentType: header.Header.Get("Content-Type"),
+		UploaderIP:      h.clientIP(r),
+		UserAgent:       r.UserAgent(),
+		ContentType:     header.Header.Get("Content-Type"),
+		RequestID:       requestID,
+		ManageTokenHash: HashToken(manageToken),
+		KeepMetadata:    r.FormValue("keep_metadata") == "true",
+		Private:         private,
+		Slug:            slug,
+	}
+	if user != nil {
+		info.OwnerID = user.ID
 	}
 
 	// Create the share
 	meta, err := h.storage.CreateShare(file, fileName, header.Size, expiresAt, info)
+	if errors.Is(err, ErrIDTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Printf("Error creating share: %v", err)
 		http.Error(w, "Error saving file", http.StatusInternalServerError)
 		return
 	}
 
+	if requestID != "" {
+		if err := h.linkRequestShare(meta); err != nil {
+			status := requestErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Error attaching share to request: %v", err)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	h.audit(r, AuditEvent{
+		Event:    AuditShareCreated,
+		ShareID:  meta.ID,
+		Version:  meta.CurrentVersion(),
+		FileName: meta.FileName,
+		Bytes:    meta.FileSize,
+	})
+
 	// Return response
 	response := map[string]string{
-		"id":  meta.ID,
-		"url": h.baseURL + "/s/" + meta.ID,
+		"id":          meta.ID,
+		"url":         h.shareURL(meta.ID),
+		"downloadUrl": h.directURL(meta.ID, meta.FileName),
+		"rawUrl":      h.shareURL(meta.ID) + "/raw",
+		"manageToken": manageToken,
+	}
+
+	if wantsPlainText(r) {
+		// The direct link comes first so `| head -1` is enough in scripts
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s\n%s\nManage token: %s\n", response["downloadUrl"], response["url"], manageToken)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// ShareInfoResponse is the JSON response for share metadata
-type ShareInfoResponse struct {
-	ID        string  `json:"id"`
-	FileName  string  `json:"fileName"`
-	FileSize  int64   `json:"fileSize"`
-	ExpiresAt *string `json:"expiresAt,omitempty"`
-}
-
-// HandleShareInfo handles GET /api/share/:id
+// HandleShareInfo handles GET and HEAD /api/share/:id
 func (h *Handlers) HandleShareInfo(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if !isReadMethod(r) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !h.checkDownloader(w, r) {
+		return
+	}
 
 	id := strings.TrimPrefix(r.URL.Path, "/api/share/")
-	if id == "" || strings.Contains(id, "/") {
+	if !ValidID(id) {
 		http.Error(w, "Invalid share ID", http.StatusBadRequest)
 		return
 	}
@@ -173,23 +554,56 @@ func (h *Handlers) HandleShareInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := ShareInfoResponse{
+	response := api.ShareInfoResponse{
 		ID:       meta.ID,
 		FileName: meta.FileName,
 		FileSize: meta.FileSize,
+		SHA256:   meta.SHA256,
+		Stripped: meta.Stripped,
+		Version:  meta.CurrentVersion(),
+	}
+	latest := meta.LatestVersion()
+	response.DetectedType, response.PreviewKind = h.versionPreview(meta, &latest)
+	for _, v := range meta.Versions {
+		response.Versions = append(response.Versions, versionResponse(v))
 	}
 	if meta.ExpiresAt != nil {
 		exp := meta.ExpiresAt.Format("2006-01-02T15:04:05Z")
 		response.ExpiresAt = &exp
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	serveJSON(w, r, response, meta.LastModified())
+}
+
+// HandleDeleteShare handles DELETE /api/share/:id, which removes a share and
+// all of its versions (management token, owner or admin)
+func (h *Handlers) HandleDeleteShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/share/")
+	if !ValidID(id) {
+		http.Error(w, "Invalid share ID", http.StatusBadRequest)
+		return
+	}
+	if !h.checkCanManage(w, r, id) {
+		return
+	}
+
+	if err := h.storage.DeleteShare(id); err != nil {
+		log.Printf("Error deleting share: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, AuditEvent{Event: AuditDelete, ShareID: id, Actor: h.manageActor(r)})
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// HandleDownload handles GET /api/share/:id/download
+// HandleDownload handles GET and HEAD /api/share/:id/download
 func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if !isReadMethod(r) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -197,9 +611,36 @@ func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	// Extract ID from path like /api/share/abc123/download
 	path := strings.TrimPrefix(r.URL.Path, "/api/share/")
 	path = strings.TrimSuffix(path, "/download")
-	id := path
+	h.serveDownload(w, r, path)
+}
+
+// HandleDirectDownload handles GET and HEAD /d/:id/:filename. The filename
+// segment is only there so curl -O and wget save the file under its real name.
+func (h *Handlers) HandleDirectDownload(w http.ResponseWriter, r *http.Request) {
+	if !isReadMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/d/")
+	id, _, _ := strings.Cut(path, "/")
+	h.serveDownload(w, r, id)
+}
+
+// HandleRawDownload handles GET and HEAD /s/:id/raw
+func (h *Handlers) HandleRawDownload(w http.ResponseWriter, r *http.Request) {
+	if !isReadMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	if id == "" || strings.Contains(id, "/") {
+	path := strings.TrimPrefix(r.URL.Path, "/s/")
+	h.serveDownload(w, r, strings.TrimSuffix(path, "/raw"))
+}
+
+// serveDownload sends a share's file (or the ?v=N version) as an attachment
+func (h *Handlers) serveDownload(w http.ResponseWriter, r *http.Request, id string) {
+	if !ValidID(id) {
 		http.Error(w, "Invalid share ID", http.StatusBadRequest)
 		return
 	}
@@ -215,13 +656,51 @@ func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := h.storage.GetFilePath(id, meta.FileName)
+	signed, ok := h.checkSignedLink(w, r, meta)
+	if !ok {
+		return
+	}
+	// A signed link is a grant of its own, so it works without signing in
+	if !signed && !h.checkDownloader(w, r) {
+		return
+	}
+
+	version := requestedVersion(w, r, meta)
+	if version == nil {
+		return
+	}
+
+	f, err := os.Open(h.storage.GetVersionPath(meta, version))
+	if err != nil {
+		log.Printf("Error opening file: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
 
 	// Set headers for download
-	w.Header().Set("Content-Disposition", "attachment; filename=\""+meta.FileName+"\"")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+version.FileName+"\"")
 	w.Header().Set("Content-Type", "application/octet-stream")
-
-	http.ServeFile(w, r, filePath)
+	h.setContentValidators(w, r, meta, version)
+	if signed {
+		// Shared caches must not keep serving a link after it expires
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+
+	// ServeContent handles HEAD, Range and the conditional headers
+	rec := &statusRecorder{ResponseWriter: w}
+	http.ServeContent(h.downloadLimit.Writer(rec, r), r, "", version.CreatedAt, f)
+	if r.Method == http.MethodGet {
+		h.audit(r, AuditEvent{
+			Event:    AuditDownload,
+			ShareID:  meta.ID,
+			Version:  version.Version,
+			FileName: version.FileName,
+			Range:    r.Header.Get("Range"),
+			Bytes:    rec.bytes,
+			Status:   rec.status,
+		})
+	}
 }
 
 // HandleUploadInit handles POST /api/upload/init
@@ -231,12 +710,7 @@ func (h *Handlers) HandleUploadInit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		FileName    string `json:"fileName"`
-		FileSize    int64  `json:"fileSize"`
-		ExpiresIn   string `json:"expiresIn,omitempty"`
-		ContentType string `json:"contentType,omitempty"`
-	}
+	var req api.InitUploadRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -250,11 +724,66 @@ func (h *Handlers) HandleUploadInit(w http.ResponseWriter, r *http.Request) {
 
 	fileName := sanitizeFileName(req.FileName)
 
+	// New versions are checked against the share below
+	user := h.currentUser(r)
+	if req.ShareID == "" && !h.checkUploader(w, r, user, req.RequestID, req.FileSize) {
+		return
+	}
+	if req.RequestID != "" {
+		if !h.checkRequestUpload(w, req.RequestID, fileName, req.FileSize) {
+			return
+		}
+		// As in HandleUpload, the request's defaults win
+		req.ExpiresIn, req.Private, req.Slug = "", false, ""
+	}
+	if req.Slug != "" && req.ShareID != "" {
+		http.Error(w, "slug and shareId are mutually exclusive", http.StatusBadRequest)
+		return
+	}
+	if !h.checkSlug(w, r, req.Slug) {
+		return
+	}
+
 	// Capture upload metadata
 	info := &UploadInfo{
-		UploaderIP:  getClientIP(r),
-		UserAgent:   r.UserAgent(),
-		ContentType: req.ContentType,
+		UploaderIP:   h.clientIP(r),
+		UserAgent:    r.UserAgent(),
+		ContentType:  req.ContentType,
+		RequestID:    req.RequestID,
+		KeepMetadata: req.KeepMetadata,
+		Private:      req.Private,
+		Slug:         req.Slug,
+	}
+	if user != nil {
+		info.OwnerID = user.ID
+	}
+	info.Actor = h.actor(r)
+
+	// A new version of an existing share needs that share's management
+	// token or its owner; new shares get a token of their own.
+	var manageToken string
+	if req.ShareID != "" {
+		if req.RequestID != "" {
+			http.Error(w, "requestId and shareId are mutually exclusive", http.StatusBadRequest)
+			return
+		}
+		if !h.checkCanManage(w, r, req.ShareID) {
+			return
+		}
+		if !h.checkVersionQuota(w, req.ShareID, req.FileSize) {
+			return
+		}
+		info.ShareID = req.ShareID
+		info.Actor = h.manageActor(r)
+	} else {
+		token, err := GenerateToken()
+		if err != nil {
+			log.Printf("Error generating token: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		manageToken = token
+		info.ManageTokenHash = HashToken(token)
 	}
 
 	session, err := h.uploads.InitUpload(fileName, req.FileSize, req.ExpiresIn, info)
@@ -263,11 +792,20 @@ func (h *Handlers) HandleUploadInit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error initializing upload", http.StatusInternalServerError)
 		return
 	}
+	h.audit(r, AuditEvent{
+		Event:    AuditUploadInit,
+		ShareID:  session.ShareID,
+		UploadID: session.ID,
+		Actor:    session.Actor,
+		FileName: session.FileName,
+		Bytes:    session.FileSize,
+	})
 
-	response := InitUploadResponse{
+	response := api.InitUploadResponse{
 		UploadID:    session.ID,
 		ChunkSize:   session.ChunkSize,
 		TotalChunks: session.TotalChunks,
+		ManageToken: manageToken,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -302,14 +840,30 @@ func (h *Handlers) HandleUploadChunk(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Upload session not found", http.StatusNotFound)
 		return
 	}
+	if !h.checkUploadOwner(w, r, session.OwnerID) {
+		return
+	}
 
-	if err := h.uploads.ReceiveChunk(uploadID, index, r.Body); err != nil {
+	if err := h.uploads.ReceiveChunk(uploadID, index, h.uploadLimit.Body(r)); err != nil {
+		if errors.Is(err, ErrUploadFinalizing) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		log.Printf("Error receiving chunk: %v", err)
 		http.Error(w, "Error receiving chunk", http.StatusInternalServerError)
 		return
 	}
 
-	response := ChunkResponse{
+	h.audit(r, AuditEvent{
+		Event:    AuditChunk,
+		ShareID:  session.ShareID,
+		UploadID: uploadID,
+		Actor:    session.Actor,
+		Chunk:    &index,
+		Bytes:    min(session.ChunkSize, session.FileSize-int64(index)*session.ChunkSize),
+	})
+
+	response := api.ChunkResponse{
 		Received: h.uploads.ReceivedCount(uploadID),
 	}
 
@@ -317,7 +871,8 @@ func (h *Handlers) HandleUploadChunk(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// HandleUploadComplete handles POST /api/upload/:uploadId/complete
+// HandleUploadComplete handles POST /api/upload/:uploadId/complete.
+// Assembly runs in the background; the response is the finalize job status.
 func (h *Handlers) HandleUploadComplete(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -328,118 +883,100 @@ func (h *Handlers) HandleUploadComplete(w http.ResponseWriter, r *http.Request)
 	path := strings.TrimPrefix(r.URL.Path, "/api/upload/")
 	uploadID := strings.TrimSuffix(path, "/complete")
 
-	session := h.uploads.GetSession(uploadID)
-	if session == nil {
-		http.Error(w, "Upload session not found", http.StatusNotFound)
+	if session := h.uploads.GetSession(uploadID); session != nil && !h.checkUploadOwner(w, r, session.OwnerID) {
 		return
 	}
 
-	if !h.uploads.IsComplete(uploadID) {
-		http.Error(w, "Upload not complete", http.StatusBadRequest)
+	job, session, started, err := h.uploads.StartFinalize(uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Calculate expiration based on session settings
-	var expiresAt *time.Time
-	if session.ExpiresIn == "" || session.ExpiresIn == "default" {
-		if h.defaultExpiry > 0 {
-			t := time.Now().Add(h.defaultExpiry)
-			expiresAt = &t
-		}
-	} else if session.ExpiresIn != "never" {
-		days, err := strconv.Atoi(session.ExpiresIn)
-		if err == nil && days > 0 {
-			t := time.Now().Add(time.Duration(days) * 24 * time.Hour)
-			expiresAt = &t
-		}
-	}
-
-	// Create the share by reading all chunks
-	reader := &chunkReader{
-		um:       h.uploads,
-		uploadID: uploadID,
-		session:  session,
+	if job == nil {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
 	}
-
-	// Use upload info from session
-	info := &UploadInfo{
-		UploaderIP:  session.UploaderIP,
-		UserAgent:   session.UserAgent,
-		ContentType: session.ContentType,
+	// The session is gone once an earlier completion has finished
+	if !h.checkUploadOwner(w, r, job.OwnerID) {
+		return
 	}
 
-	meta, err := h.storage.CreateShare(reader, session.FileName, session.FileSize, expiresAt, info)
-	if err != nil {
-		log.Printf("Error creating share: %v", err)
-		http.Error(w, "Error creating share", http.StatusInternalServerError)
-		return
+	if started {
+		go h.runFinalize(job, session)
 	}
 
-	// Cleanup the upload session
-	h.uploads.Cleanup(uploadID)
+	h.writeJob(w, job)
+}
 
-	response := map[string]string{
-		"id":  meta.ID,
-		"url": h.baseURL + "/s/" + meta.ID,
+// shareListItem converts share metadata to its list response format
+func (h *Handlers) shareListItem(meta *ShareMeta) api.ShareListItem {
+	item := api.ShareListItem{
+		ID:          meta.ID,
+		FileName:    meta.FileName,
+		FileSize:    meta.FileSize,
+		CreatedAt:   meta.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		UploaderIP:  meta.UploaderIP,
+		UserAgent:   meta.UserAgent,
+		ContentType: meta.ContentType,
+		RequestID:   meta.RequestID,
+		OwnerID:     meta.OwnerID,
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	if meta.ExpiresAt != nil {
+		exp := meta.ExpiresAt.Format("2006-01-02T15:04:05Z")
+		item.ExpiresAt = &exp
+	}
+	if meta.HasThumbnail {
+		item.ThumbnailURL = h.thumbnailURL(meta.ID)
+	}
+	return item
 }
 
-// ShareListItem is the JSON response for a share in the list
-type ShareListItem struct {
-	ID          string  `json:"id"`
-	FileName    string  `json:"fileName"`
-	FileSize    int64   `json:"fileSize"`
-	CreatedAt   string  `json:"createdAt"`
-	ExpiresAt   *string `json:"expiresAt,omitempty"`
-	UploaderIP  string  `json:"uploaderIP,omitempty"`
-	UserAgent   string  `json:"userAgent,omitempty"`
-	ContentType string  `json:"contentType,omitempty"`
+// thumbnailURL returns the absolute URL of a share's thumbnail
+func (h *Handlers) thumbnailURL(id string) string {
+	return h.baseURL + "/api/share/" + id + "/thumb"
 }
 
-// HandleListShares handles GET /api/shares
+// HandleListShares handles GET /api/shares. See ParseShareQuery for the
+// filter, sort and paging parameters. Admins may list every share; other
+// accounts only see their own.
 func (h *Handlers) HandleListShares(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	// Parse optional limit parameter
-	limit := 0
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
-		if n, err := strconv.Atoi(limitStr); err == nil && n > 0 {
-			limit = n
+	query, err := ParseShareQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if admin := h.isAdmin(r); !admin || query.Owner == "me" {
+		user := h.currentUser(r)
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Sign in to list your shares", http.StatusUnauthorized)
+			return
 		}
+		query.Owner = user.ID
 	}
 
-	shares, err := h.storage.ListShares(limit)
+	shares, err := h.storage.ListShares(0)
 	if err != nil {
 		log.Printf("Error listing shares: %v", err)
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	page, total, next := query.Apply(shares)
 
 	// Convert to response format
-	items := make([]ShareListItem, 0, len(shares))
-	for _, meta := range shares {
-		item := ShareListItem{
-			ID:          meta.ID,
-			FileName:    meta.FileName,
-			FileSize:    meta.FileSize,
-			CreatedAt:   meta.CreatedAt.Format("2006-01-02T15:04:05Z"),
-			UploaderIP:  meta.UploaderIP,
-			UserAgent:   meta.UserAgent,
-			ContentType: meta.ContentType,
-		}
-		if meta.ExpiresAt != nil {
-			exp := meta.ExpiresAt.Format("2006-01-02T15:04:05Z")
-			item.ExpiresAt = &exp
-		}
-		items = append(items, item)
+	response := api.ShareListResponse{
+		Shares:     make([]api.ShareListItem, 0, len(page)),
+		Total:      total,
+		NextCursor: next,
+	}
+	for _, meta := range page {
+		response.Shares = append(response.Shares, h.shareListItem(meta))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(items)
+	json.NewEncoder(w).Encode(response)
 }
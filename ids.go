@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Share ID schemes
+const (
+	IDSchemeRandom = "random" // random characters from an alphabet
+	IDSchemeWords  = "words"  // dictionary words joined by dashes
+)
+
+const (
+	base62Alphabet   = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	defaultIDLength  = 8
+	defaultWordCount = 4
+	minIDLength      = 4
+	maxIDLength      = 64
+	minSlugLength    = 3
+	idAttempts       = 10 // collisions tolerated before giving up
+)
+
+var (
+	// ErrIDTaken means a requested share ID already exists
+	ErrIDTaken = errors.New("ID already in use")
+	// ErrInvalidSlug means a requested share ID isn't allowed
+	ErrInvalidSlug = errors.New("invalid slug")
+	// ErrInvalidID means an ID from outside could not have been generated here
+	ErrInvalidID = errors.New("invalid ID")
+)
+
+// reservedSlugs can't be claimed as vanity IDs. They read like pages of the
+// site, which makes them useful for phishing.
+var reservedSlugs = map[string]bool{
+	"about": true, "account": true, "admin": true, "api": true,
+	"d": true, "download": true, "help": true, "login": true,
+	"logout": true, "new": true, "oembed": true, "qr": true,
+	"r": true, "raw": true, "requests": true, "s": true,
+	"settings": true, "share": true, "shares": true, "static": true,
+	"upload": true, "uploads": true,
+}
+
+// idWords is the word list for the words scheme: 256 short, distinct words,
+// so each adds 8 bits
+var idWords = [256]string{
+	"acorn", "actor", "adobe", "agent", "alarm", "album", "alder", "alley",
+	"alpha", "amber", "angle", "anvil", "apple", "apron", "arena", "arrow",
+	"aspen", "atlas", "attic", "autumn", "badge", "bagel", "baker", "bamboo",
+	"banjo", "barley", "basil", "basin", "beach", "beacon", "bean", "bear",
+	"beaver", "berry", "birch", "bison", "blade", "blaze", "bloom", "bonus",
+	"boots", "brave", "bread", "brick", "bridge", "brook", "broom", "bubble",
+	"bucket", "buddy", "bugle", "cabin", "cable", "cactus", "camel", "canal",
+	"candle", "canoe", "canyon", "cargo", "carrot", "castle", "cedar", "cello",
+	"chalk", "charm", "cherry", "chess", "chief", "cider", "cinema", "circle",
+	"citrus", "clay", "cliff", "clock", "cloud", "clover", "coast", "cobalt",
+	"cocoa", "comet", "coral", "cotton", "cougar", "crane", "crater", "crayon",
+	"crown", "cube", "daisy", "dawn", "delta", "denim", "desert", "diner",
+	"dingo", "diver", "domino", "dove", "dragon", "dream", "drum", "dune",
+	"eagle", "easel", "echo", "elbow", "elder", "ember", "engine", "falcon",
+	"fable", "fennel", "fern", "ferry", "fiddle", "field", "finch", "fjord",
+	"flame", "flint", "flute", "focus", "forest", "fossil", "fox", "frost",
+	"galaxy", "garden", "garnet", "gecko", "geyser", "ginger", "glacier",
+	"globe", "goose", "grape", "gravel", "guitar", "harbor", "hazel", "heron",
+	"honey", "hornet", "husky", "igloo", "indigo", "iris", "island", "ivory",
+	"jacket", "jade", "jaguar", "jasper", "jelly", "jungle", "kayak", "kettle",
+	"kiwi", "koala", "ladder", "lagoon", "lantern", "laser", "lemon", "lilac",
+	"lime", "linen", "lizard", "llama", "locket", "lotus", "lunar", "magnet",
+	"mango", "maple", "marble", "meadow", "melon", "meteor", "mint", "mocha",
+	"moose", "mosaic", "moss", "nectar", "needle", "nickel", "noodle", "nutmeg",
+	"oasis", "ocean", "olive", "onyx", "orbit", "orchid", "otter", "owl",
+	"oyster", "paddle", "panda", "papaya", "parrot", "pebble", "pecan",
+	"pepper", "piano", "pickle", "pilot", "pine", "planet", "plum", "polar",
+	"pony", "poppy", "prism", "puffin", "pumpkin", "quartz", "quill", "rabbit",
+	"radar", "raven", "reef", "ribbon", "river", "robin", "rocket", "ruby",
+	"saddle", "salmon", "satin", "shell", "sierra", "silver", "sketch", "slate",
+	"sparrow", "spruce", "squid", "summit", "sunset", "swan", "tango",
+	"thunder", "tiger", "timber", "topaz", "tulip", "tundra", "turtle",
+	"velvet", "violet", "walnut", "willow",
+}
+
+// isIDChar reports whether c may appear in an ID. Keeping IDs to this set
+// makes them safe as path segments and in URLs.
+func isIDChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// ValidID reports whether an externally supplied share, upload or request
+// ID is well formed. Every ID kiss-drop creates, under any generator
+// setting, passes; anything else (".", "..", separators, other Unicode) is
+// rejected before it gets near a file path. Storage, UploadManager and
+// RequestStore check it on every lookup.
+func ValidID(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if !isIDChar(id[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// IDGenerator creates share IDs
+type IDGenerator struct {
+	scheme   string
+	length   int // characters, or words for the words scheme
+	alphabet string
+}
+
+// NewIDGenerator creates a generator for a scheme. Zero length and empty
+// alphabet select the defaults.
+func NewIDGenerator(scheme string, length int, alphabet string) (*IDGenerator, error) {
+	g := &IDGenerator{scheme: scheme, length: length, alphabet: alphabet}
+	switch scheme {
+	case IDSchemeRandom, "":
+		g.scheme = IDSchemeRandom
+		if g.length == 0 {
+			g.length = defaultIDLength
+		}
+		if g.alphabet == "" {
+			g.alphabet = base62Alphabet
+		}
+		if g.length < minIDLength || g.length > maxIDLength {
+			return nil, fmt.Errorf("ID length must be between %d and %d", minIDLength, maxIDLength)
+		}
+		if len(g.alphabet) < 2 || len(g.alphabet) > 256 {
+			return nil, fmt.Errorf("ID alphabet must have between 2 and 256 characters")
+		}
+		seen := make(map[byte]bool)
+		for i := 0; i < len(g.alphabet); i++ {
+			c := g.alphabet[i]
+			if !isIDChar(c) {
+				return nil, fmt.Errorf("ID alphabet may only contain A-Z, a-z, 0-9, - and _, got %q", c)
+			}
+			if seen[c] {
+				return nil, fmt.Errorf("ID alphabet repeats %q", c)
+			}
+			seen[c] = true
+		}
+	case IDSchemeWords:
+		if g.length == 0 {
+			g.length = defaultWordCount
+		}
+		if g.length < 2 || g.length > 8 {
+			return nil, fmt.Errorf("word IDs must have between 2 and 8 words")
+		}
+	default:
+		return nil, fmt.Errorf("unknown ID scheme %q", scheme)
+	}
+	return g, nil
+}
+
+// Bits returns the entropy of a generated ID
+func (g *IDGenerator) Bits() float64 {
+	if g.scheme == IDSchemeWords {
+		return float64(g.length * 8)
+	}
+	return float64(g.length) * math.Log2(float64(len(g.alphabet)))
+}
+
+// Generate returns a new random ID
+func (g *IDGenerator) Generate() (string, error) {
+	if g.scheme == IDSchemeWords {
+		idx, err := randomIndexes(len(idWords), g.length)
+		if err != nil {
+			return "", err
+		}
+		words := make([]string, len(idx))
+		for i, n := range idx {
+			words[i] = idWords[n]
+		}
+		return strings.Join(words, "-"), nil
+	}
+	return randomString(g.alphabet, g.length)
+}
+
+// randomIndexes returns count uniformly random integers in [0, n), n <= 256.
+// Bytes that would bias the result toward low values are rejected.
+func randomIndexes(n, count int) ([]int, error) {
+	limit := 256 - 256%n
+	out := make([]int, 0, count)
+	buf := make([]byte, count*2)
+	for len(out) < count {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(out) < count {
+				out = append(out, int(b)%n)
+			}
+		}
+	}
+	return out, nil
+}
+
+// randomString returns n characters drawn uniformly from alphabet
+func randomString(alphabet string, n int) (string, error) {
+	idx, err := randomIndexes(len(alphabet), n)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	for i, j := range idx {
+		b[i] = alphabet[j]
+	}
+	return string(b), nil
+}
+
+// GenerateID creates a random 8-character base62 ID for internal objects
+// such as upload sessions and file requests
+func GenerateID() (string, error) {
+	return randomString(base62Alphabet, defaultIDLength)
+}
+
+// ValidateSlug checks an admin-chosen vanity ID
+func ValidateSlug(slug string) error {
+	if len(slug) < minSlugLength || len(slug) > maxIDLength {
+		return fmt.Errorf("%w: must be %d to %d characters", ErrInvalidSlug, minSlugLength, maxIDLength)
+	}
+	for i := 0; i < len(slug); i++ {
+		if !isIDChar(slug[i]) {
+			return fmt.Errorf("%w: only A-Z, a-z, 0-9, - and _ are allowed", ErrInvalidSlug)
+		}
+	}
+	if reservedSlugs[strings.ToLower(slug)] {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidSlug, slug)
+	}
+	return nil
+}
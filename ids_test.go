@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var idSeeds = []string{
+	"", ".", "..", "../", "../download", "..\\x", "a/b", "/etc",
+	"%2e%2e", "%2f", "abc\x00def", "ünïcödé", "AbC123", "my-share_1",
+}
+
+// FuzzValidID checks that every ID accepted by ValidID names a direct child
+// of the shares directory
+func FuzzValidID(f *testing.F) {
+	for _, s := range idSeeds {
+		f.Add(s)
+	}
+	root := filepath.Join("data", "shares")
+	f.Fuzz(func(t *testing.T, id string) {
+		if !ValidID(id) {
+			return
+		}
+		p := filepath.Join(root, id)
+		if filepath.Dir(p) != root || filepath.Base(p) != id {
+			t.Fatalf("ValidID(%q) escapes %s: %s", id, root, p)
+		}
+	})
+}
+
+// FuzzGetShare checks that no share ID can reach metadata outside shares/
+func FuzzGetShare(f *testing.F) {
+	for _, s := range idSeeds {
+		f.Add(s)
+	}
+
+	dataDir := f.TempDir()
+	storage, err := NewStorage(dataDir, StorageOptions{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	// Decoys that a traversing ID could resolve to
+	decoy := []byte(`{"id":"decoy","file_name":"decoy"}`)
+	for _, dir := range []string{dataDir, filepath.Join(dataDir, "uploads")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			f.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "meta.json"), decoy, 0644); err != nil {
+			f.Fatal(err)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, id string) {
+		meta, _ := storage.GetShare(id)
+		if meta != nil {
+			t.Fatalf("GetShare(%q) returned metadata from outside shares/", id)
+		}
+		if storage.ShareExists(id) {
+			t.Fatalf("ShareExists(%q) found a share outside shares/", id)
+		}
+	})
+}
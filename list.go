@@ -0,0 +1,284 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Share list sort keys
+const (
+	SortCreated = "created"
+	SortName    = "name"
+	SortSize    = "size"
+	SortExpires = "expires"
+)
+
+// Share list status filters
+const (
+	StatusActive    = "active"
+	StatusExpired   = "expired"
+	StatusPermanent = "permanent"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ShareQuery selects, orders and pages shares for GET /api/shares
+type ShareQuery struct {
+	Name          string // case-insensitive file name substring
+	ContentType   string // content type or prefix such as "image/"
+	MinSize       int64
+	MaxSize       int64 // 0 = no limit
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	ExpiresAfter  *time.Time
+	ExpiresBefore *time.Time
+	UploaderIP    string
+	Owner         string // account ID; "me" is resolved by the handler
+	Status        string
+	Sort          string
+	Desc          bool
+	Limit         int
+	Cursor        *shareCursor
+	now           time.Time
+}
+
+// shareCursor marks the last share of a page. It records the sort order so
+// that it can't be replayed against a different one.
+type shareCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d,omitempty"`
+	Num  int64  `json:"n,omitempty"`
+	Str  string `json:"t,omitempty"`
+	ID   string `json:"i"`
+}
+
+// encode returns the opaque form of a cursor used in URLs
+func (c *shareCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseTimeParam accepts an RFC 3339 timestamp or a YYYY-MM-DD date (UTC midnight)
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// ParseShareQuery reads a share query from URL parameters
+func ParseShareQuery(q url.Values) (*ShareQuery, error) {
+	query := &ShareQuery{
+		Name:        strings.ToLower(q.Get("q")),
+		ContentType: strings.ToLower(q.Get("type")),
+		UploaderIP:  q.Get("uploader_ip"),
+		Owner:       q.Get("owner"),
+		Status:      q.Get("status"),
+		Sort:        q.Get("sort"),
+		Limit:       defaultListLimit,
+		now:         time.Now(),
+	}
+
+	switch query.Status {
+	case "", StatusActive, StatusExpired, StatusPermanent:
+	default:
+		return nil, fmt.Errorf("invalid status %q", query.Status)
+	}
+
+	if query.Sort == "" {
+		query.Sort = SortCreated
+	}
+	switch query.Sort {
+	case SortCreated, SortName, SortSize, SortExpires:
+	default:
+		return nil, fmt.Errorf("invalid sort %q", query.Sort)
+	}
+	switch order := q.Get("order"); order {
+	case "":
+		// Newest and largest first; names and expiry dates read best ascending
+		query.Desc = query.Sort == SortCreated || query.Sort == SortSize
+	case "asc", "desc":
+		query.Desc = order == "desc"
+	default:
+		return nil, fmt.Errorf("invalid order %q", order)
+	}
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit %q", s)
+		}
+		query.Limit = min(n, maxListLimit)
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"min_size", &query.MinSize}, {"max_size", &query.MaxSize}} {
+		if s := q.Get(p.name); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s %q", p.name, s)
+			}
+			*p.dst = n
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{
+		{"created_after", &query.CreatedAfter},
+		{"created_before", &query.CreatedBefore},
+		{"expires_after", &query.ExpiresAfter},
+		{"expires_before", &query.ExpiresBefore},
+	} {
+		if s := q.Get(p.name); s != "" {
+			t, err := parseTimeParam(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", p.name, s)
+			}
+			*p.dst = &t
+		}
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		var c shareCursor
+		if err != nil || json.Unmarshal(data, &c) != nil ||
+			c.Sort != query.Sort || c.Desc != query.Desc {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		query.Cursor = &c
+	}
+
+	return query, nil
+}
+
+// Match reports whether a share passes the query's filters
+func (query *ShareQuery) Match(meta *ShareMeta) bool {
+	if query.Name != "" && !strings.Contains(strings.ToLower(meta.FileName), query.Name) {
+		return false
+	}
+	if query.ContentType != "" &&
+		!strings.HasPrefix(strings.ToLower(meta.ContentType), query.ContentType) &&
+		!strings.HasPrefix(strings.ToLower(meta.DetectedType), query.ContentType) {
+		return false
+	}
+	if meta.FileSize < query.MinSize || (query.MaxSize > 0 && meta.FileSize > query.MaxSize) {
+		return false
+	}
+	if query.CreatedAfter != nil && meta.CreatedAt.Before(*query.CreatedAfter) {
+		return false
+	}
+	if query.CreatedBefore != nil && !meta.CreatedAt.Before(*query.CreatedBefore) {
+		return false
+	}
+	if query.ExpiresAfter != nil && (meta.ExpiresAt != nil && meta.ExpiresAt.Before(*query.ExpiresAfter)) {
+		return false
+	}
+	if query.ExpiresBefore != nil && (meta.ExpiresAt == nil || !meta.ExpiresAt.Before(*query.ExpiresBefore)) {
+		return false
+	}
+	if query.UploaderIP != "" && meta.UploaderIP != query.UploaderIP {
+		return false
+	}
+	if query.Owner != "" && meta.OwnerID != query.Owner {
+		return false
+	}
+
+	expired := meta.ExpiresAt != nil && meta.ExpiresAt.Before(query.now)
+	switch query.Status {
+	case StatusActive:
+		return !expired
+	case StatusExpired:
+		return expired
+	case StatusPermanent:
+		return meta.ExpiresAt == nil
+	}
+	return true
+}
+
+// cursorFor returns the cursor positioned at a share
+func (query *ShareQuery) cursorFor(meta *ShareMeta) *shareCursor {
+	c := &shareCursor{Sort: query.Sort, Desc: query.Desc, ID: meta.ID}
+	switch query.Sort {
+	case SortCreated:
+		c.Num = meta.CreatedAt.UnixNano()
+	case SortName:
+		c.Str = strings.ToLower(meta.FileName)
+	case SortSize:
+		c.Num = meta.FileSize
+	case SortExpires:
+		// Permanent shares come after every expiry date
+		c.Num = math.MaxInt64
+		if meta.ExpiresAt != nil {
+			c.Num = meta.ExpiresAt.UnixNano()
+		}
+	}
+	return c
+}
+
+// before reports whether share position a comes before b in the query's
+// order. Ties on the sort key are broken by ID, so the order is total.
+func (query *ShareQuery) before(a, b *shareCursor) bool {
+	c := cmp.Compare(a.Num, b.Num)
+	if c == 0 {
+		c = strings.Compare(a.Str, b.Str)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	if query.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// Apply filters, sorts and pages shares. It returns the page, the number of
+// matching shares and the cursor of the next page ("" on the last page).
+func (query *ShareQuery) Apply(shares []*ShareMeta) (page []*ShareMeta, total int, next string) {
+	type entry struct {
+		meta *ShareMeta
+		pos  *shareCursor
+	}
+	var matched []entry
+	for _, meta := range shares {
+		if query.Match(meta) {
+			matched = append(matched, entry{meta, query.cursorFor(meta)})
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return query.before(matched[i].pos, matched[j].pos)
+	})
+
+	start := 0
+	if query.Cursor != nil {
+		// Resume after the cursor's position, which stays valid when the
+		// share it names has been deleted
+		start = sort.Search(len(matched), func(i int) bool {
+			return query.before(query.Cursor, matched[i].pos)
+		})
+	}
+	end := min(start+query.Limit, len(matched))
+
+	page = make([]*ShareMeta, 0, end-start)
+	for _, e := range matched[start:end] {
+		page = append(page, e.meta)
+	}
+	if end < len(matched) {
+		next = matched[end-1].pos.encode()
+	}
+	return page, len(matched), next
+}
@@ -27,38 +27,132 @@ func parseDuration(s string, defaultDays int) time.Duration {
 	return time.Duration(days) * 24 * time.Hour
 }
 
+// parseSize parses a byte count such as "512K", "10MB" or "1G". Empty or
+// invalid values return 0.
+func parseSize(value string) int64 {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if s == "" {
+		return 0
+	}
+	s = strings.TrimSuffix(s, "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		log.Printf("Ignoring invalid size %q", value)
+		return 0
+	}
+	return n * multiplier
+}
+
+// parseRequestLimit reads a request limit from the environment, exiting if
+// it is invalid
+func parseRequestLimit(key, defaultValue string) *RequestLimit {
+	limit, err := ParseRequestLimit(getEnv(key, defaultValue))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return limit
+}
+
+// openAuditLog opens the audit log set up by the AUDIT_LOG variables, or
+// returns nil when it is turned off
+func openAuditLog(dataDir string) (*AuditLog, error) {
+	if getEnv("AUDIT_LOG", "true") != "true" {
+		return nil, nil
+	}
+	keep, _ := strconv.Atoi(getEnv("AUDIT_LOG_KEEP", "5"))
+	return OpenAuditLog(dataDir, parseSize(getEnv("AUDIT_LOG_MAX_SIZE", "10M")), keep)
+}
+
 func startCleanupWorker(storage *Storage, interval time.Duration) {
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
 		// Run immediately on startup
-		deleted, err := storage.CleanupExpired()
-		if err != nil {
-			log.Printf("Cleanup error: %v", err)
-		} else if deleted > 0 {
-			log.Printf("Cleaned up %d expired share(s)", deleted)
-		}
+		runCleanup(storage, CleanupStartup)
 
 		for range ticker.C {
-			deleted, err := storage.CleanupExpired()
-			if err != nil {
-				log.Printf("Cleanup error: %v", err)
-			} else if deleted > 0 {
-				log.Printf("Cleaned up %d expired share(s)", deleted)
-			}
+			runCleanup(storage, CleanupScheduled)
 		}
 	}()
 }
 
+// runCleanup removes expired shares and logs the outcome
+func runCleanup(storage *Storage, trigger string) {
+	run, err := storage.CleanupExpired(trigger)
+	if err != nil {
+		log.Printf("Cleanup error: %v", err)
+	} else if run.Deleted > 0 {
+		log.Printf("Cleaned up %d expired share(s)", run.Deleted)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	port := getEnv("PORT", "8080")
 	dataDir := getEnv("DATA_DIR", "./data")
 	baseURL := getEnv("BASE_URL", "http://localhost:"+port)
 	defaultExpiry := parseDuration(getEnv("DEFAULT_EXPIRY", "30d"), 30)
+	adminToken := getEnv("ADMIN_TOKEN", "")
+	maxVersions, err := strconv.Atoi(getEnv("MAX_VERSIONS", "10"))
+	if err != nil || maxVersions < 0 {
+		log.Fatalf("Invalid MAX_VERSIONS %q", getEnv("MAX_VERSIONS", "10"))
+	}
+	stripMetadata := getEnv("STRIP_METADATA", "false") == "true"
+
+	// Bandwidth limits in bytes per second (0 = unlimited)
+	downloadLimit := NewThrottle(
+		parseSize(getEnv("DOWNLOAD_RATE_LIMIT", "")),
+		parseSize(getEnv("DOWNLOAD_RATE_LIMIT_GLOBAL", "")),
+	)
+	uploadLimit := NewThrottle(
+		parseSize(getEnv("UPLOAD_RATE_LIMIT", "")),
+		parseSize(getEnv("UPLOAD_RATE_LIMIT_GLOBAL", "")),
+	)
+
+	idLength, _ := strconv.Atoi(getEnv("ID_LENGTH", "0"))
+	ids, err := NewIDGenerator(getEnv("ID_SCHEME", IDSchemeRandom), idLength, getEnv("ID_ALPHABET", ""))
+	if err != nil {
+		log.Fatalf("Invalid share ID settings: %v", err)
+	}
+	if ids.Bits() < 40 {
+		log.Printf("Warning: share IDs have only %.0f bits of entropy and may be guessable", ids.Bits())
+	}
+
+	unfurl, err := parseUnfurlMode(getEnv("UNFURL", UnfurlFull))
+	if err != nil {
+		log.Fatalf("Invalid link preview settings: %v", err)
+	}
+
+	audit, err := openAuditLog(dataDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize audit log: %v", err)
+	}
 
 	// Initialize storage
-	storage, err := NewStorage(dataDir)
+	storage, err := NewStorage(dataDir, StorageOptions{
+		MaxVersions:   maxVersions,
+		StripMetadata: stripMetadata,
+		IDs:           ids,
+		Audit:         audit,
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
@@ -69,6 +163,51 @@ func main() {
 		log.Fatalf("Failed to initialize upload manager: %v", err)
 	}
 
+	// Initialize file request store
+	requests, err := NewRequestStore(dataDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize request store: %v", err)
+	}
+
+	trustedProxies, err := ParseIPSet(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	proxyHeader, err := ParseProxyHeader(getEnv("TRUSTED_PROXY_HEADER", ""))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXY_HEADER: %v", err)
+	}
+
+	// Accounts are optional; without them every upload is anonymous. Users
+	// signed in by a reverse proxy get accounts too, to own their shares.
+	var users *UserStore
+	forwardAuthHeader := getEnv("FORWARD_AUTH_HEADER", "")
+	if getEnv("ACCOUNTS", "false") == "true" || forwardAuthHeader != "" {
+		if users, err = NewUserStore(dataDir); err != nil {
+			log.Fatalf("Failed to initialize user store: %v", err)
+		}
+	}
+	var forwardAuth *ForwardAuth
+	if forwardAuthHeader != "" {
+		var headers []string
+		for _, header := range strings.Split(forwardAuthHeader, ",") {
+			if header = strings.TrimSpace(header); header != "" {
+				headers = append(headers, header)
+			}
+		}
+		if forwardAuth, err = NewForwardAuth(headers, trustedProxies, users); err != nil {
+			log.Fatalf("Invalid forward auth settings: %v", err)
+		}
+	}
+	loginToUpload := users != nil && getEnv("ANONYMOUS_UPLOADS", "true") != "true"
+	loginToDownload := users != nil && getEnv("ANONYMOUS_DOWNLOADS", "true") != "true"
+
+	// Request limits per client IP, separate from the bandwidth limits
+	uploadRequests := parseRequestLimit("REQUEST_LIMIT_UPLOAD", "30/m")
+	downloadRequests := parseRequestLimit("REQUEST_LIMIT_DOWNLOAD", "300/m")
+	notFoundRequests := parseRequestLimit("REQUEST_LIMIT_NOT_FOUND", "20/m")
+	loginRequests := parseRequestLimit("REQUEST_LIMIT_LOGIN", "10/m")
+
 	// Start cleanup worker (runs every hour)
 	startCleanupWorker(storage, time.Hour)
 
@@ -79,7 +218,24 @@ func main() {
 	}
 
 	// Initialize handlers
-	handlers := NewHandlers(storage, uploads, baseURL, defaultExpiry)
+	handlers := NewHandlers(storage, uploads, requests, HandlerOptions{
+		BaseURL:         baseURL,
+		DefaultExpiry:   defaultExpiry,
+		AdminToken:      adminToken,
+		DownloadLimit:   downloadLimit,
+		UploadLimit:     uploadLimit,
+		SigningSecret:   getEnv("SIGNING_SECRET", ""),
+		Unfurl:          unfurl,
+		Users:           users,
+		TrustedProxies:  trustedProxies,
+		ProxyHeader:     proxyHeader,
+		ForwardAuth:     forwardAuth,
+		LoginToUpload:   loginToUpload,
+		LoginToDownload: loginToDownload,
+		DefaultQuota:    parseSize(getEnv("DEFAULT_QUOTA", "")),
+		NotFoundLimit:   notFoundRequests,
+		Audit:           audit,
+	})
 
 	// Serve static files
 	staticContent, err := fs.Sub(staticFS, "static")
@@ -97,14 +253,50 @@ func main() {
 		handlers.HandleUploadPage(w, r, templates)
 	})
 
-	http.HandleFunc("/s/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/s/", handlers.RateLimit(downloadRequests, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/raw") {
+			handlers.HandleRawDownload(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/qr.png") || strings.HasSuffix(r.URL.Path, "/qr.svg") {
+			handlers.HandleQRCode(w, r)
+			return
+		}
 		handlers.HandleDownloadPage(w, r, templates)
+	}))
+
+	http.HandleFunc("/d/", handlers.RateLimit(downloadRequests, handlers.HandleDirectDownload))
+	http.HandleFunc("/oembed", handlers.RateLimit(downloadRequests, handlers.HandleOEmbed))
+	http.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleAdminPage(w, r, templates)
+	})
+
+	http.HandleFunc("/login", handlers.LimitLogins(loginRequests, func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleLoginPage(w, r, templates)
+	}))
+	http.HandleFunc("/logout", handlers.HandleLogout)
+	http.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleAccountPage(w, r, templates)
 	})
 
+	http.HandleFunc("/r/", handlers.RateLimit(downloadRequests, func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleRequestPage(w, r, templates)
+	}))
+
 	// API Routes
 	http.HandleFunc("/api/shares", handlers.HandleListShares)
-	http.HandleFunc("/api/upload", handlers.HandleUpload)
-	http.HandleFunc("/api/upload/init", handlers.HandleUploadInit)
+	http.HandleFunc("/api/admin/status", handlers.HandleAdminStatus)
+	http.HandleFunc("/api/admin/delete", handlers.HandleAdminDelete)
+	http.HandleFunc("/api/admin/expiry", handlers.HandleAdminExpiry)
+	http.HandleFunc("/api/admin/cleanup", handlers.HandleAdminCleanup)
+	http.HandleFunc("/api/admin/audit", handlers.HandleAdminAudit)
+	http.HandleFunc("/api/account", handlers.HandleAccount)
+	http.HandleFunc("/api/account/keys", handlers.HandleAccountKeys)
+	http.HandleFunc("/api/account/keys/", handlers.HandleAccountKey)
+	http.HandleFunc("/api/requests", handlers.HandleRequests)
+	http.HandleFunc("/api/requests/", handlers.HandleRequest)
+	http.HandleFunc("/api/upload", handlers.RateLimit(uploadRequests, handlers.HandleUpload))
+	http.HandleFunc("/api/upload/init", handlers.RateLimit(uploadRequests, handlers.HandleUploadInit))
 	http.HandleFunc("/api/upload/", func(w http.ResponseWriter, r *http.Request) {
 		// Route chunked upload endpoints
 		path := r.URL.Path
@@ -112,23 +304,45 @@ func main() {
 			handlers.HandleUploadChunk(w, r)
 		} else if strings.HasSuffix(path, "/complete") {
 			handlers.HandleUploadComplete(w, r)
+		} else if strings.HasSuffix(path, "/status") {
+			handlers.HandleUploadStatus(w, r)
 		} else {
 			http.NotFound(w, r)
 		}
 	})
 
-	http.HandleFunc("/api/share/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/share/", handlers.RateLimit(downloadRequests, func(w http.ResponseWriter, r *http.Request) {
 		// Route to appropriate handler based on path
 		if strings.HasSuffix(r.URL.Path, "/download") {
 			handlers.HandleDownload(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/thumb") {
+			handlers.HandleThumbnail(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/preview") {
+			handlers.HandlePreview(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/entry") {
+			handlers.HandleArchiveEntry(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/signed-links") {
+			handlers.HandleSignedLinks(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/versions") {
+			handlers.HandleShareVersions(w, r)
+		} else if r.Method == http.MethodDelete {
+			handlers.HandleDeleteShare(w, r)
 		} else {
 			handlers.HandleShareInfo(w, r)
 		}
-	})
+	}))
 
 	log.Printf("Starting kiss-drop on :%s", port)
 	log.Printf("Data directory: %s", dataDir)
 	log.Printf("Default expiry: %s", defaultExpiry)
+	if users != nil {
+		log.Printf("Accounts enabled (anonymous uploads: %t, anonymous downloads: %t)", !loginToUpload, !loginToDownload)
+	}
+	log.Printf("Request limits per IP: upload %s, download %s, not found %s, login %s",
+		uploadRequests, downloadRequests, notFoundRequests, loginRequests)
+	if forwardAuth != nil {
+		log.Printf("Trusting %s from %s", forwardAuthHeader, getEnv("TRUSTED_PROXIES", ""))
+	}
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
 		log.Fatal(err)
 	}
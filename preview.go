@@ -0,0 +1,236 @@
+package main
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Preview kinds rendered by the download page
+const (
+	PreviewImage = "image"
+	PreviewVideo = "video"
+	PreviewAudio = "audio"
+	PreviewPDF   = "pdf"
+	PreviewText  = "text"
+)
+
+// maxTextPreview is how much of a text file is shown on the download page
+const maxTextPreview = 64 * 1024
+
+// previewTypes is the allowlist of content types that may be shown inline.
+// Anything else (HTML, SVG, XML, ...) could run script in our origin and is
+// only ever served as an attachment.
+var previewTypes = map[string]string{
+	"image/png":       PreviewImage,
+	"image/jpeg":      PreviewImage,
+	"image/gif":       PreviewImage,
+	"image/webp":      PreviewImage,
+	"image/bmp":       PreviewImage,
+	"video/mp4":       PreviewVideo,
+	"video/webm":      PreviewVideo,
+	"video/ogg":       PreviewVideo,
+	"audio/mpeg":      PreviewAudio,
+	"audio/ogg":       PreviewAudio,
+	"audio/wav":       PreviewAudio,
+	"audio/wave":      PreviewAudio,
+	"audio/webm":      PreviewAudio,
+	"audio/flac":      PreviewAudio,
+	"audio/mp4":       PreviewAudio,
+	"audio/aac":       PreviewAudio,
+	"application/pdf": PreviewPDF,
+	"text/plain":      PreviewText,
+}
+
+// previewKindFor returns the preview kind for a detected content type, or ""
+// if the type must not be rendered inline
+func previewKindFor(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return previewTypes[mediaType]
+}
+
+// mediaExtensions maps extensions of media formats that content sniffing
+// can't tell apart, since the system MIME table may not know them
+var mediaExtensions = map[string]string{
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".weba": "audio/webm",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".ogv":  "video/ogg",
+	".webm": "video/webm",
+}
+
+// containerTypes lists sniffed container formats and the more specific
+// types an extension may narrow them to
+var containerTypes = map[string][]string{
+	"video/mp4":       {"audio/mp4"},
+	"video/webm":      {"audio/webm"},
+	"application/ogg": {"audio/ogg", "video/ogg"},
+}
+
+// detectContentType sniffs the real type of a file from its first bytes.
+// The extension only refines the result where sniffing is ambiguous, so a
+// renamed file can't claim to be text or markup it isn't.
+func detectContentType(path, fileName string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	sniffed := http.DetectContentType(buf[:n])
+	sniffedMedia, _, _ := mime.ParseMediaType(sniffed)
+
+	ext := strings.ToLower(filepath.Ext(fileName))
+	extMedia := mediaExtensions[ext]
+	if extMedia == "" {
+		extMedia, _, _ = mime.ParseMediaType(mime.TypeByExtension(ext))
+	}
+	if extMedia == "" {
+		return sniffed
+	}
+
+	// Sniffing doesn't recognize every media format; trust the extension
+	// for binary media but never upgrade unknown bytes to text
+	if sniffedMedia == "application/octet-stream" {
+		if kind := previewTypes[extMedia]; kind != "" && kind != PreviewText {
+			return extMedia
+		}
+		return sniffed
+	}
+
+	for _, narrowed := range containerTypes[sniffedMedia] {
+		if extMedia == narrowed {
+			return extMedia
+		}
+	}
+	return sniffed
+}
+
+// versionPreview returns the detected type and preview kind of a share
+// version, detecting it now for shares uploaded before detection existed
+func (h *Handlers) versionPreview(meta *ShareMeta, v *ShareVersion) (string, string) {
+	detected := v.DetectedType
+	if detected == "" {
+		detected = detectContentType(h.storage.GetVersionPath(meta, v), v.FileName)
+	}
+	return detected, previewKindFor(detected)
+}
+
+// readTextPreview returns the beginning of a text file as valid UTF-8
+func readTextPreview(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	buf := make([]byte, maxTextPreview+1)
+	n, _ := io.ReadFull(f, buf)
+	truncated := n > maxTextPreview
+	if truncated {
+		n = maxTextPreview
+	}
+	return strings.ToValidUTF8(string(buf[:n]), string(utf8.RuneError)), truncated
+}
+
+// HandlePreview handles GET and HEAD /api/share/:id/preview, serving
+// allowlisted types inline with a locked-down CSP so the browser can render them
+func (h *Handlers) HandlePreview(w http.ResponseWriter, r *http.Request) {
+	if !isReadMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.checkDownloader(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/share/")
+	id := strings.TrimSuffix(path, "/preview")
+	if !ValidID(id) {
+		http.Error(w, "Invalid share ID", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := h.storage.GetShare(id)
+	if err != nil {
+		log.Printf("Error getting share: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if meta == nil {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+
+	version := requestedVersion(w, r, meta)
+	if version == nil {
+		return
+	}
+
+	detected, kind := h.versionPreview(meta, version)
+	if kind == "" {
+		http.Error(w, "Preview not available", http.StatusUnsupportedMediaType)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(detected)
+	if kind == PreviewText {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	// The sandbox directive turns the response into an opaque origin.
+	// Browser PDF viewers refuse to run sandboxed, so PDFs only get the
+	// fetch restrictions.
+	csp := "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'"
+	if kind != PreviewPDF {
+		csp += "; sandbox"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "inline; filename=\""+version.FileName+"\"")
+	w.Header().Set("Content-Security-Policy", csp)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cross-Origin-Resource-Policy", "same-origin")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	h.setContentValidators(w, r, meta, version)
+
+	f, err := os.Open(h.storage.GetVersionPath(meta, version))
+	if err != nil {
+		log.Printf("Error opening file: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	rec := &statusRecorder{ResponseWriter: w}
+	http.ServeContent(h.downloadLimit.Writer(rec, r), r, "", version.CreatedAt, f)
+	if r.Method == http.MethodGet {
+		h.audit(r, AuditEvent{
+			Event:    AuditDownload,
+			ShareID:  meta.ID,
+			Version:  version.Version,
+			FileName: version.FileName,
+			Range:    r.Header.Get("Range"),
+			Bytes:    rec.bytes,
+			Status:   rec.status,
+			Detail:   "preview",
+		})
+	}
+}
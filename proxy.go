@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPSet is a list of networks, such as the reverse proxies trusted to set
+// forwarding and authentication headers
+type IPSet []netip.Prefix
+
+// ParseIPSet parses a comma or space separated list of CIDRs. Plain
+// addresses stand for themselves.
+func ParseIPSet(s string) (IPSet, error) {
+	var set IPSet
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", field)
+			}
+			set = append(set, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", field)
+		}
+		set = append(set, prefix.Masked())
+	}
+	return set, nil
+}
+
+// Contains reports whether addr is in one of the networks
+func (s IPSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range s {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerAddr returns the address of the host directly connected to the server,
+// which is the proxy when there is one
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// parseHop parses one address from a forwarding header: a bare IP, or one
+// with a port, with IPv6 addresses optionally in brackets
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err == nil {
+		return addr.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// forwardedFor returns the for= addresses of RFC 7239 Forwarded headers,
+// client first
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, val)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// Forwarding headers that TRUSTED_PROXY_HEADER can name
+const (
+	ProxyHeaderXForwardedFor = "X-Forwarded-For"
+	ProxyHeaderForwarded     = "Forwarded"
+	ProxyHeaderXRealIP       = "X-Real-IP"
+)
+
+// ParseProxyHeader returns the forwarding header named by s, in any case.
+// Empty means X-Forwarded-For.
+func ParseProxyHeader(s string) (string, error) {
+	for _, header := range []string{ProxyHeaderXForwardedFor, ProxyHeaderForwarded, ProxyHeaderXRealIP} {
+		if strings.EqualFold(s, header) {
+			return header, nil
+		}
+	}
+	if s == "" {
+		return ProxyHeaderXForwardedFor, nil
+	}
+	return "", fmt.Errorf("unknown header %q: must be x-forwarded-for, forwarded or x-real-ip", s)
+}
+
+// forwardingHops returns the client addresses recorded by proxies in header,
+// client first. Only the header the proxies actually set is read: one that
+// they pass through untouched is entirely up to the client.
+func forwardingHops(r *http.Request, header string) []string {
+	values := r.Header.Values(header)
+	if header == ProxyHeaderForwarded {
+		return forwardedFor(values)
+	}
+	var hops []string
+	for _, value := range values {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	return hops
+}
+
+// clientIP returns the address of the client that made a request. Each
+// trusted proxy appends the address it got the request from to header, so
+// it is read from the right: the first address that isn't a trusted proxy
+// is the client. Anything further left could have been made up by the
+// client, and requests that don't come from a trusted proxy can't vouch for
+// any header at all.
+func clientIP(r *http.Request, trusted IPSet, header string) string {
+	client, ok := peerAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !trusted.Contains(client) {
+		return client.String()
+	}
+
+	hops := forwardingHops(r, header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			// Obfuscated or garbled, so nothing to its left can be trusted
+			break
+		}
+		client = addr
+		if !trusted.Contains(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// ForwardAuth reads the user name that an authenticating reverse proxy,
+// such as Authelia or oauth2-proxy, puts in a request header. Headers on
+// requests that don't come from a trusted proxy are ignored, since anyone
+// could set them.
+type ForwardAuth struct {
+	headers []string
+	proxies IPSet
+	users   *UserStore
+}
+
+// NewForwardAuth trusts the first non-empty header of headers on requests
+// from proxies
+func NewForwardAuth(headers []string, proxies IPSet, users *UserStore) (*ForwardAuth, error) {
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("forward auth needs TRUSTED_PROXIES")
+	}
+	return &ForwardAuth{headers: headers, proxies: proxies, users: users}, nil
+}
+
+// identity returns the user name set by a trusted proxy, if any
+func (fa *ForwardAuth) identity(r *http.Request) string {
+	addr, ok := peerAddr(r)
+	if !ok || !fa.proxies.Contains(addr) {
+		return ""
+	}
+	for _, header := range fa.headers {
+		if name := strings.TrimSpace(r.Header.Get(header)); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// User returns the account of the user named by a trusted proxy, creating
+// it the first time that user shows up. It returns nil for requests
+// without a trusted identity.
+func (fa *ForwardAuth) User(r *http.Request) (*User, error) {
+	name := fa.identity(r)
+	if name == "" {
+		return nil, nil
+	}
+	if !validUserName(name) {
+		log.Printf("Ignoring forward auth user %q: %v", name, ErrInvalidUserName)
+		return nil, nil
+	}
+
+	user, err := fa.users.FindUser(name)
+	if err != nil || user != nil {
+		return user, err
+	}
+	// Accounts made here have no password; the proxy does the signing in
+	user, err = fa.users.CreateUser(name, "", false, 0)
+	if errors.Is(err, ErrUserExists) {
+		// Another request got there first
+		return fa.users.FindUser(name)
+	}
+	if err == nil {
+		log.Printf("Created account %s for forward auth user", user.Name)
+	}
+	return user, err
+}
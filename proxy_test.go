@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseIPSet("10.0.0.0/8, 2001:db8:ffff::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		header  string // TRUSTED_PROXY_HEADER
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:   "no proxy",
+			remote: "203.0.113.5:4000",
+			want:   "203.0.113.5",
+		},
+		{
+			name:    "untrusted peer can't set XFF",
+			remote:  "203.0.113.5:4000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:    "203.0.113.5",
+		},
+		{
+			name:    "untrusted peer can't set Forwarded",
+			remote:  "203.0.113.5:4000",
+			header:  ProxyHeaderForwarded,
+			headers: map[string]string{"Forwarded": "for=198.51.100.1"},
+			want:    "203.0.113.5",
+		},
+		{
+			name:    "XFF from a trusted proxy",
+			remote:  "10.0.0.2:4000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "spoofed XFF entries left of the client",
+			remote:  "10.0.0.2:4000",
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 10.9.9.9, 198.51.100.1, 10.0.0.3"},
+			want:    "198.51.100.1",
+		},
+		{
+			name:   "spoofed Forwarded passed through an XFF proxy",
+			remote: "10.0.0.2:4000",
+			headers: map[string]string{
+				"Forwarded":       "for=1.1.1.1",
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:   "spoofed XFF passed through a Forwarded proxy",
+			remote: "10.0.0.2:4000",
+			header: ProxyHeaderForwarded,
+			headers: map[string]string{
+				"Forwarded":       "for=198.51.100.1;proto=https",
+				"X-Forwarded-For": "1.1.1.1",
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:    "spoofed Forwarded entries left of the client",
+			remote:  "10.0.0.2:4000",
+			header:  ProxyHeaderForwarded,
+			headers: map[string]string{"Forwarded": "for=1.1.1.1, for=198.51.100.1;by=10.0.0.2"},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "Forwarded IPv6 in brackets with port",
+			remote:  "10.0.0.2:4000",
+			header:  ProxyHeaderForwarded,
+			headers: map[string]string{"Forwarded": `for="[2001:db8::17]:4711"`},
+			want:    "2001:db8::17",
+		},
+		{
+			name:    "XFF IPv6 in brackets",
+			remote:  "[2001:db8:ffff::1]:4000",
+			headers: map[string]string{"X-Forwarded-For": "[2001:db8::17]"},
+			want:    "2001:db8::17",
+		},
+		{
+			name:    "IPv4-mapped IPv6",
+			remote:  "[::ffff:10.0.0.2]:4000",
+			headers: map[string]string{"X-Forwarded-For": "::ffff:198.51.100.1"},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "obfuscated hop stops the walk",
+			remote:  "10.0.0.2:4000",
+			header:  ProxyHeaderForwarded,
+			headers: map[string]string{"Forwarded": "for=1.1.1.1, for=_hidden, for=10.0.0.3"},
+			want:    "10.0.0.3",
+		},
+		{
+			name:    "all trusted",
+			remote:  "10.0.0.2:4000",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.4, 10.0.0.3"},
+			want:    "10.0.0.4",
+		},
+		{
+			name:   "trusted proxy without the header",
+			remote: "10.0.0.2:4000",
+			want:   "10.0.0.2",
+		},
+		{
+			name:    "X-Real-IP",
+			remote:  "10.0.0.2:4000",
+			header:  ProxyHeaderXRealIP,
+			headers: map[string]string{"X-Real-IP": "198.51.100.1", "X-Forwarded-For": "1.1.1.1"},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "X-Real-IP ignored by default",
+			remote:  "10.0.0.2:4000",
+			headers: map[string]string{"X-Real-IP": "1.1.1.1"},
+			want:    "10.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := ParseProxyHeader(tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := clientIP(r, trusted, header); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                ProxyHeaderXForwardedFor,
+		"x-forwarded-for": ProxyHeaderXForwardedFor,
+		"FORWARDED":       ProxyHeaderForwarded,
+		"x-real-ip":       ProxyHeaderXRealIP,
+	} {
+		if got, err := ParseProxyHeader(in); err != nil || got != want {
+			t.Errorf("ParseProxyHeader(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseProxyHeader("x-client-ip"); err == nil {
+		t.Error("ParseProxyHeader accepted x-client-ip")
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// QR codes are encoded in byte mode at error correction level M, which
+// survives about 15% damage: enough for a phone camera at an angle.
+
+const (
+	qrBorder   = 4 // quiet zone in modules, as the spec requires
+	qrPNGScale = 8 // pixels per module in PNG output
+)
+
+// errQRTooLong means the text doesn't fit in the largest QR version
+var errQRTooLong = errors.New("text too long for a QR code")
+
+// Level M error correction codewords per block, indexed by version
+var qrECCPerBlock = [41]int{0,
+	10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+	26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+}
+
+// Level M error correction block count, indexed by version
+var qrNumBlocks = [41]int{0,
+	1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+	17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49,
+}
+
+// QRCode is a square grid of modules, true meaning dark
+type QRCode struct {
+	Size     int
+	modules  []bool
+	reserved []bool // function patterns, which data and masks skip
+}
+
+// Dark reports whether the module at (x, y) is dark
+func (q *QRCode) Dark(x, y int) bool {
+	return q.modules[y*q.Size+x]
+}
+
+func (q *QRCode) set(x, y int, dark bool) {
+	q.modules[y*q.Size+x] = dark
+}
+
+// setFunction sets a module that belongs to a function pattern
+func (q *QRCode) setFunction(x, y int, dark bool) {
+	q.set(x, y, dark)
+	q.reserved[y*q.Size+x] = true
+}
+
+// EncodeQR encodes text as a QR code using the smallest version that fits
+func EncodeQR(text string) (*QRCode, error) {
+	data := []byte(text)
+
+	version := 0
+	for v := 1; v <= 40; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= qrDataCodewords(v)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	codewords := qrAddECC(version, qrDataBits(version, data))
+
+	// Keep the mask with the lowest penalty score
+	var best *QRCode
+	bestPenalty := 0
+	for mask := 0; mask < 8; mask++ {
+		q := qrBuild(version, codewords, mask)
+		if p := q.penalty(); best == nil || p < bestPenalty {
+			best, bestPenalty = q, p
+		}
+	}
+	return best, nil
+}
+
+// qrRawModules returns the number of modules available for codewords
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		n -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// qrDataCodewords returns the number of data codewords a version holds at level M
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[version]*qrNumBlocks[version]
+}
+
+// qrDataBits builds the byte mode segment, padded to the version's capacity
+func qrDataBits(version int, data []byte) []byte {
+	var bits []bool
+	appendBits := func(val, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (val>>i)&1 != 0)
+		}
+	}
+
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	appendBits(0b0100, 4) // byte mode
+	appendBits(len(data), countBits)
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+
+	capacity := qrDataCodewords(version) * 8
+	appendBits(0, min(4, capacity-len(bits))) // terminator
+	appendBits(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		appendBits(pad, 8)
+	}
+
+	out := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// qrAddECC splits data into blocks, appends Reed-Solomon error correction to
+// each and interleaves the result
+func qrAddECC(version int, data []byte) []byte {
+	numBlocks := qrNumBlocks[version]
+	eccLen := qrECCPerBlock[version]
+	rawCodewords := qrRawModules(version) / 8
+	numShort := numBlocks - rawCodewords%numBlocks
+	shortLen := rawCodewords / numBlocks
+
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range blocks {
+		dataLen := shortLen - eccLen
+		if i >= numShort {
+			dataLen++
+		}
+		dat := data[k : k+dataLen]
+		k += dataLen
+
+		// Short blocks get a placeholder so all blocks line up
+		block := make([]byte, shortLen+1)
+		copy(block, dat)
+		copy(block[len(block)-eccLen:], rsRemainder(dat, divisor))
+		blocks[i] = block
+	}
+
+	out := make([]byte, 0, rawCodewords)
+	for i := 0; i < shortLen+1; i++ {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				out = append(out, block[i])
+			}
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given degree
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords for data
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMul(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// qrBuild lays out function patterns and codewords with the given mask
+func qrBuild(version int, codewords []byte, mask int) *QRCode {
+	size := version*4 + 17
+	q := &QRCode{
+		Size:     size,
+		modules:  make([]bool, size*size),
+		reserved: make([]bool, size*size),
+	}
+
+	// Timing patterns
+	for i := 0; i < size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns with their separators
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= size || y < 0 || y >= size {
+					continue
+				}
+				dist := max(abs(dx), abs(dy))
+				q.setFunction(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+
+	// Alignment patterns, except where they would overlap the finders
+	pos := qrAlignmentPositions(version)
+	for i, cy := range pos {
+		for j, cx := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	q.drawFormat(mask)
+	q.drawVersion(version)
+
+	// Codewords zigzag up and down in two-module columns from the right
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = size - 1 - vert // upward column
+				}
+				if q.reserved[y*size+x] || i >= len(codewords)*8 {
+					continue
+				}
+				q.set(x, y, (codewords[i/8]>>(7-i%8))&1 != 0)
+				i++
+			}
+		}
+	}
+
+	// Apply the mask to everything but the function patterns
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if !q.reserved[y*size+x] && qrMaskBit(mask, x, y) {
+				q.set(x, y, !q.Dark(x, y))
+			}
+		}
+	}
+	return q
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// qrAlignmentPositions returns the centers of alignment patterns on each axis
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	numAlign := version/7 + 2
+	step := (version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	pos := make([]int, numAlign)
+	pos[0] = 6
+	for i, p := numAlign-1, version*4+10; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// qrMaskBit reports whether a mask pattern flips the module at (x, y)
+func qrMaskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// drawFormat writes both copies of the format information (level M and the
+// mask) plus the always-dark module
+func (q *QRCode) drawFormat(mask int) {
+	data := mask // level M is 0b00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	size := q.Size
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.setFunction(size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, size-15+i, bit(i))
+	}
+	q.setFunction(8, size-8, true)
+}
+
+// drawVersion writes the version information blocks used from version 7 on
+func (q *QRCode) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 != 0
+		a, b := q.Size-11+i%3, i/3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// penalty scores how hard the code is to scan; lower is better
+func (q *QRCode) penalty() int {
+	size := q.Size
+	score := 0
+
+	// Runs of five or more same-colored modules, and finder-like patterns,
+	// in each row and column
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	for pass := 0; pass < 2; pass++ {
+		for a := 0; a < size; a++ {
+			line := make([]bool, size)
+			for b := 0; b < size; b++ {
+				if pass == 0 {
+					line[b] = q.Dark(b, a)
+				} else {
+					line[b] = q.Dark(a, b)
+				}
+			}
+
+			run := 1
+			for b := 1; b <= size; b++ {
+				if b < size && line[b] == line[b-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+
+			for b := 0; b+11 <= size; b++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k, dark := range pattern {
+						if line[b+k] != dark {
+							match = false
+							break
+						}
+					}
+					if match {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of one color
+	for y := 0; y < size-1; y++ {
+		for x := 0; x < size-1; x++ {
+			c := q.Dark(x, y)
+			if c == q.Dark(x+1, y) && c == q.Dark(x, y+1) && c == q.Dark(x+1, y+1) {
+				score += 3
+			}
+		}
+	}
+
+	// Balance of dark and light modules
+	dark := 0
+	for _, m := range q.modules {
+		if m {
+			dark++
+		}
+	}
+	total := size * size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	score += k * 10
+
+	return score
+}
+
+// PNG renders the code as a black and white PNG
+func (q *QRCode) PNG() ([]byte, error) {
+	dim := (q.Size + 2*qrBorder) * qrPNGScale
+	img := image.NewPaletted(image.Rect(0, 0, dim, dim), color.Palette{color.White, color.Black})
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if !q.Dark(x, y) {
+				continue
+			}
+			for dy := 0; dy < qrPNGScale; dy++ {
+				row := ((y+qrBorder)*qrPNGScale + dy) * img.Stride
+				for dx := 0; dx < qrPNGScale; dx++ {
+					img.Pix[row+(x+qrBorder)*qrPNGScale+dx] = 1
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the code as a scalable SVG image
+func (q *QRCode) SVG() string {
+	dim := q.Size + 2*qrBorder
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, dim, dim)
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.Dark(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+qrBorder, y+qrBorder)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
+
+// HandleQRCode handles GET /s/:id/qr.png and /s/:id/qr.svg, rendering the
+// share link as a QR code
+func (h *Handlers) HandleQRCode(w http.ResponseWriter, r *http.Request) {
+	if !isReadMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.checkDownloader(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/s/")
+	id, format, _ := strings.Cut(path, "/qr.")
+	if !ValidID(id) || (format != "png" && format != "svg") {
+		http.Error(w, "Invalid share ID", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := h.storage.GetShare(id)
+	if err != nil {
+		log.Printf("Error getting share: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if meta == nil {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+
+	code, err := EncodeQR(h.shareURL(meta.ID))
+	if err != nil {
+		log.Printf("Error encoding QR code: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var body []byte
+	if format == "png" {
+		if body, err = code.PNG(); err != nil {
+			log.Printf("Error rendering QR code: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+	} else {
+		body = []byte(code.SVG())
+		w.Header().Set("Content-Type", "image/svg+xml")
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", h.cacheControl(meta, false))
+	http.ServeContent(w, r, "", meta.CreatedAt, bytes.NewReader(body))
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestRSRemainder checks the error correction of the 1-M example in
+// ISO/IEC 18004 Annex I ("01234567" in numeric mode)
+func TestRSRemainder(t *testing.T) {
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	want := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+	if got := rsRemainder(data, rsDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("ECC = % X, want % X", got, want)
+	}
+}
+
+// Format information for level M and masks 0-7, from the spec's table
+var qrFormatBits = [8]int{0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0}
+
+// Version information from the spec's table
+var qrVersionBits = map[int]int{7: 0x07C94, 10: 0x0A4D3, 40: 0x28C69}
+
+// qrTestVersion describes a version at level M, from the spec's tables
+type qrTestVersion struct {
+	version   int
+	align     []int // alignment pattern centers
+	total     int   // codewords
+	blocks    int
+	eccLength int // per block
+	capacity  int // bytes in byte mode
+}
+
+var qrTestVersions = []qrTestVersion{
+	{1, nil, 26, 1, 10, 14},
+	{2, []int{6, 18}, 44, 1, 16, 26},
+	{5, []int{6, 30}, 134, 2, 24, 84},
+	{7, []int{6, 22, 38}, 196, 4, 18, 122},
+	{10, []int{6, 28, 50}, 346, 5, 26, 213},
+	{40, []int{6, 30, 58, 86, 114, 142, 170}, 3706, 49, 28, 2331},
+}
+
+// TestEncodeQR encodes the longest text each version holds and decodes the
+// result independently of the encoder. EncodeQR only uses level M.
+func TestEncodeQR(t *testing.T) {
+	for _, tv := range qrTestVersions {
+		text := strings.Repeat("https://drop.example.com/s/", tv.capacity)[:tv.capacity]
+		q, err := EncodeQR(text)
+		if err != nil {
+			t.Fatalf("version %d: %v", tv.version, err)
+		}
+		if want := tv.version*4 + 17; q.Size != want {
+			t.Fatalf("version %d: size %d, want %d", tv.version, q.Size, want)
+		}
+		got, err := decodeQR(q, tv)
+		if err != nil {
+			t.Fatalf("version %d: %v", tv.version, err)
+		}
+		if got != text {
+			t.Errorf("version %d: decoded %q, want %q", tv.version, got, text)
+		}
+
+		// One more byte needs the next version
+		if q, err := EncodeQR(text + "x"); err == nil && q.Size == tv.version*4+17 {
+			t.Errorf("version %d holds more than %d bytes", tv.version, tv.capacity)
+		}
+	}
+
+	if _, err := EncodeQR(strings.Repeat("x", 2332)); !errors.Is(err, errQRTooLong) {
+		t.Errorf("2332 bytes: err = %v, want errQRTooLong", err)
+	}
+}
+
+// qrFunctionModules marks the modules that don't carry data
+func qrFunctionModules(tv qrTestVersion) [][]bool {
+	size := tv.version*4 + 17
+	fn := make([][]bool, size)
+	for y := range fn {
+		fn[y] = make([]bool, size)
+	}
+	fill := func(x0, y0, w, h int) {
+		for y := y0; y < y0+h; y++ {
+			for x := x0; x < x0+w; x++ {
+				fn[y][x] = true
+			}
+		}
+	}
+	// Finders, separators and format information
+	fill(0, 0, 9, 9)
+	fill(size-8, 0, 8, 9)
+	fill(0, size-8, 9, 8)
+	// Timing
+	fill(6, 0, 1, size)
+	fill(0, 6, size, 1)
+	// Alignment patterns, except the three on the finders
+	last := len(tv.align) - 1
+	for i, cy := range tv.align {
+		for j, cx := range tv.align {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			fill(cx-2, cy-2, 5, 5)
+		}
+	}
+	if tv.version >= 7 {
+		fill(size-11, 0, 3, 6)
+		fill(0, size-11, 6, 3)
+	}
+	return fn
+}
+
+// decodeQR reads a byte mode, level M code back into text, checking the
+// format and version information and every block's error correction
+func decodeQR(q *QRCode, tv qrTestVersion) (string, error) {
+	size := q.Size
+	bit := func(x, y int) int {
+		if q.Dark(x, y) {
+			return 1
+		}
+		return 0
+	}
+
+	// Both copies of the format information must name the same mask
+	var format1, format2 int
+	for i := 0; i <= 5; i++ {
+		format1 |= bit(8, i) << i
+	}
+	format1 |= bit(8, 7)<<6 | bit(8, 8)<<7 | bit(7, 8)<<8
+	for i := 9; i < 15; i++ {
+		format1 |= bit(14-i, 8) << i
+	}
+	for i := 0; i < 8; i++ {
+		format2 |= bit(size-1-i, 8) << i
+	}
+	for i := 8; i < 15; i++ {
+		format2 |= bit(8, size-15+i) << i
+	}
+	if format1 != format2 {
+		return "", errors.New("format information copies differ")
+	}
+	mask := -1
+	for m, bits := range qrFormatBits {
+		if bits == format1 {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		return "", errors.New("format information is not level M")
+	}
+	if !q.Dark(8, size-8) {
+		return "", errors.New("dark module is light")
+	}
+
+	if want, ok := qrVersionBits[tv.version]; ok {
+		var v1, v2 int
+		for i := 0; i < 18; i++ {
+			v1 |= bit(size-11+i%3, i/3) << i
+			v2 |= bit(i/3, size-11+i%3) << i
+		}
+		if v1 != want || v2 != want {
+			return "", errors.New("wrong version information")
+		}
+	}
+
+	// Read the zigzag, undoing the mask (i is the row, j the column)
+	masks := [8]func(i, j int) bool{
+		func(i, j int) bool { return (i+j)%2 == 0 },
+		func(i, j int) bool { return i%2 == 0 },
+		func(i, j int) bool { return j%3 == 0 },
+		func(i, j int) bool { return (i+j)%3 == 0 },
+		func(i, j int) bool { return (i/2+j/3)%2 == 0 },
+		func(i, j int) bool { return (i*j)%2+(i*j)%3 == 0 },
+		func(i, j int) bool { return ((i*j)%2+(i*j)%3)%2 == 0 },
+		func(i, j int) bool { return ((i+j)%2+(i*j)%3)%2 == 0 },
+	}
+	fn := qrFunctionModules(tv)
+	var stream []byte
+	var cur byte
+	n := 0
+	upward := true
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for k := 0; k < size; k++ {
+			y := k
+			if upward {
+				y = size - 1 - k
+			}
+			for _, x := range []int{right, right - 1} {
+				if fn[y][x] {
+					continue
+				}
+				dark := q.Dark(x, y) != masks[mask](y, x)
+				cur <<= 1
+				if dark {
+					cur |= 1
+				}
+				if n++; n%8 == 0 {
+					stream = append(stream, cur)
+					cur = 0
+				}
+			}
+		}
+		upward = !upward
+	}
+	if len(stream) != tv.total {
+		return "", errors.New("wrong number of codewords")
+	}
+
+	// Undo the interleaving; the first blocks are one data codeword short
+	short := tv.blocks - tv.total%tv.blocks
+	shortData := tv.total/tv.blocks - tv.eccLength
+	blocks := make([][]byte, tv.blocks)
+	i := 0
+	for k := 0; k <= shortData; k++ {
+		for b := range blocks {
+			if k < shortData || b >= short {
+				blocks[b] = append(blocks[b], stream[i])
+				i++
+			}
+		}
+	}
+	for k := 0; k < tv.eccLength; k++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], stream[i])
+			i++
+		}
+	}
+
+	// A block without errors evaluates to zero at every root of the generator
+	var data []byte
+	for b, block := range blocks {
+		for r := 0; r < tv.eccLength; r++ {
+			if qrEvaluate(block, qrPow(r)) != 0 {
+				return "", fmt.Errorf("block %d fails error correction", b)
+			}
+		}
+		data = append(data, block[:len(block)-tv.eccLength]...)
+	}
+
+	// Byte mode header, then the text
+	pos := 0
+	read := func(bits int) int {
+		v := 0
+		for ; bits > 0; bits-- {
+			v = v<<1 | int(data[pos/8]>>(7-pos%8)&1)
+			pos++
+		}
+		return v
+	}
+	if mode := read(4); mode != 0b0100 {
+		return "", errors.New("not byte mode")
+	}
+	countBits := 8
+	if tv.version >= 10 {
+		countBits = 16
+	}
+	length := read(countBits)
+	out := make([]byte, length)
+	for k := range out {
+		out[k] = byte(read(8))
+	}
+	return string(out), nil
+}
+
+// qrPow returns 2^n in GF(256) with the QR polynomial 0x11D
+func qrPow(n int) byte {
+	v := 1
+	for ; n > 0; n-- {
+		v <<= 1
+		if v&0x100 != 0 {
+			v ^= 0x11D
+		}
+	}
+	return byte(v)
+}
+
+// qrEvaluate evaluates a polynomial, highest coefficient first, at x
+func qrEvaluate(poly []byte, x byte) byte {
+	var y byte
+	for _, c := range poly {
+		y = qrMul(y, x) ^ c
+	}
+	return y
+}
+
+// qrMul multiplies in GF(256) bit by bit
+func qrMul(a, b byte) byte {
+	var p byte
+	for ; b > 0; b >>= 1 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		hi := a & 0x80
+		a <<= 1
+		if hi != 0 {
+			a ^= 0x1D
+		}
+	}
+	return p
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestLimit is a token bucket of requests per client IP. A client may
+// send up to the limit at once and then one more every window/limit. A nil
+// RequestLimit allows everything.
+type RequestLimit struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*requestBucket
+	swept   time.Time
+}
+
+// requestBucket is one client's budget
+type requestBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limitState describes a client's bucket for the RateLimit headers
+type limitState struct {
+	ok        bool
+	remaining int
+	reset     time.Duration // until the bucket is full again
+	retry     time.Duration // until the next request is allowed
+}
+
+// ParseRequestLimit parses a limit such as "60/m", "10/s" or "1000/h".
+// Empty, "0" and "off" mean unlimited.
+func ParseRequestLimit(s string) (*RequestLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" || s == "off" {
+		return nil, nil
+	}
+	count, unit, _ := strings.Cut(s, "/")
+	limit, err := strconv.Atoi(count)
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("invalid request limit %q", s)
+	}
+	var window time.Duration
+	switch unit {
+	case "s":
+		window = time.Second
+	case "m", "":
+		window = time.Minute
+	case "h":
+		window = time.Hour
+	default:
+		return nil, fmt.Errorf("invalid request limit %q: unit must be s, m or h", s)
+	}
+	return &RequestLimit{limit: limit, window: window, buckets: make(map[string]*requestBucket)}, nil
+}
+
+// String formats the limit the way ParseRequestLimit reads it
+func (l *RequestLimit) String() string {
+	if l == nil {
+		return "off"
+	}
+	unit := "m"
+	switch l.window {
+	case time.Second:
+		unit = "s"
+	case time.Hour:
+		unit = "h"
+	}
+	return fmt.Sprintf("%d/%s", l.limit, unit)
+}
+
+// rate is how many requests come back per second
+func (l *RequestLimit) rate() float64 {
+	return float64(l.limit) / l.window.Seconds()
+}
+
+// take spends one request from key's bucket, if one is left
+func (l *RequestLimit) take(key string) limitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	b := l.buckets[key]
+	if b == nil {
+		b = &requestBucket{tokens: float64(l.limit), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(l.limit), b.tokens+now.Sub(b.last).Seconds()*l.rate())
+	b.last = now
+
+	state := limitState{ok: b.tokens >= 1}
+	if state.ok {
+		b.tokens--
+	}
+	state.remaining = int(b.tokens)
+	state.reset = l.wait(float64(l.limit) - b.tokens)
+	if !state.ok {
+		state.retry = l.wait(1 - b.tokens)
+	}
+	return state
+}
+
+// refund gives back a request taken from key's bucket
+func (l *RequestLimit) refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b := l.buckets[key]; b != nil {
+		b.tokens = min(float64(l.limit), b.tokens+1)
+	}
+}
+
+// wait is how long it takes to earn n requests
+func (l *RequestLimit) wait(n float64) time.Duration {
+	return time.Duration(n / l.rate() * float64(time.Second))
+}
+
+// sweep forgets the clients whose buckets have filled up again, since a
+// fresh bucket is the same as a full one. It runs at most once a window.
+func (l *RequestLimit) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate() >= float64(l.limit) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// limitKey is the bucket a client IP counts against. IPv6 clients usually
+// get a whole /64, so they share one bucket rather than one per address.
+func limitKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() {
+		return ip
+	}
+	prefix, _ := addr.Prefix(64)
+	return prefix.String()
+}
+
+// seconds rounds d up to whole seconds for the rate limit headers
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// setLimitHeaders describes the client's budget in the RateLimit headers
+// from the IETF httpapi draft
+func (l *RequestLimit) setLimitHeaders(w http.ResponseWriter, state limitState) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(l.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.remaining))
+	w.Header().Set("RateLimit-Reset", seconds(state.reset))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.limit, int(l.window.Seconds())))
+}
+
+// tooManyRequests turns a client away until its bucket has a request again
+func tooManyRequests(w http.ResponseWriter, state limitState) {
+	w.Header().Set("Retry-After", seconds(state.retry))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// statusRecorder remembers the status code and body size a handler sent
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// onStatus, if set, learns the status as soon as it's sent, before any
+	// of the body
+	onStatus func(status int)
+}
+
+// setStatus records the first status sent
+func (rec *statusRecorder) setStatus(status int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = status
+	if rec.onStatus != nil {
+		rec.onStatus(status)
+	}
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.setStatus(status)
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	rec.setStatus(http.StatusOK)
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection's writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// RateLimit wraps next so each client IP may call it within limit. Every
+// 404 also costs the client from the not-found limit, and clients that have
+// used that up are turned away, which slows down guessing share IDs much
+// more than the route limit alone. The 404 is charged up front, so parallel
+// guesses can't all pass on the last one, and refunded as soon as another
+// status is sent, so long downloads don't hold on to it. Admins aren't
+// limited.
+func (h *Handlers) RateLimit(limit *RequestLimit, next http.HandlerFunc) http.HandlerFunc {
+	if limit == nil && h.notFoundLimit == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.isAdmin(r) {
+			next(w, r)
+			return
+		}
+		key := limitKey(h.clientIP(r))
+
+		if h.notFoundLimit != nil {
+			if state := h.notFoundLimit.take(key); !state.ok {
+				h.notFoundLimit.setLimitHeaders(w, state)
+				tooManyRequests(w, state)
+				return
+			}
+		}
+		if limit != nil {
+			state := limit.take(key)
+			limit.setLimitHeaders(w, state)
+			if !state.ok {
+				if h.notFoundLimit != nil {
+					h.notFoundLimit.refund(key)
+				}
+				tooManyRequests(w, state)
+				return
+			}
+		}
+
+		if h.notFoundLimit == nil {
+			next(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, onStatus: func(status int) {
+			if status != http.StatusNotFound {
+				h.notFoundLimit.refund(key)
+			}
+		}}
+		next(rec, r)
+		if rec.status == 0 {
+			// Nothing was written, which net/http sends as an empty 200
+			h.notFoundLimit.refund(key)
+		}
+	}
+}
+
+// LimitLogins wraps a sign-in handler so each client IP may try a password
+// within limit, since every try costs a slow password hash and a chance to
+// guess. Only POSTs count, so the form itself always loads.
+func (h *Handlers) LimitLogins(limit *RequestLimit, next http.HandlerFunc) http.HandlerFunc {
+	if limit == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			state := limit.take(limitKey(h.clientIP(r)))
+			limit.setLimitHeaders(w, state)
+			if !state.ok {
+				tooManyRequests(w, state)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestParseRequestLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // String() of the limit, "" for an error
+	}{
+		{"", "off"},
+		{"0", "off"},
+		{"off", "off"},
+		{"60/m", "60/m"},
+		{"60", "60/m"},
+		{" 10/s ", "10/s"},
+		{"1000/h", "1000/h"},
+		{"10/d", ""},
+		{"-1/m", ""},
+		{"x/m", ""},
+	}
+	for _, tt := range tests {
+		limit, err := ParseRequestLimit(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ParseRequestLimit(%q) = %s, want an error", tt.in, limit)
+			}
+			continue
+		}
+		if err != nil || limit.String() != tt.want {
+			t.Errorf("ParseRequestLimit(%q) = %s, %v; want %s", tt.in, limit, err, tt.want)
+		}
+	}
+}
+
+// limitTestHandler answers /missing with a 404, /empty with nothing at all
+// and everything else with a 200
+func limitTestHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/missing":
+		http.NotFound(w, r)
+	case "/empty":
+	default:
+		w.Write([]byte("ok"))
+	}
+}
+
+func mustRequestLimit(t *testing.T, s string) *RequestLimit {
+	t.Helper()
+	limit, err := ParseRequestLimit(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return limit
+}
+
+func TestRateLimit(t *testing.T) {
+	type step struct {
+		path   string
+		remote string // default 192.0.2.1
+		admin  bool
+		want   int
+	}
+	tests := []struct {
+		name     string
+		limit    string
+		notFound string
+		steps    []step
+	}{
+		{
+			name:  "route limit",
+			limit: "3/m",
+			steps: []step{
+				{path: "/ok", want: 200},
+				{path: "/missing", want: 404},
+				{path: "/ok", want: 200},
+				{path: "/ok", want: 429},
+				{path: "/ok", remote: "192.0.2.2", want: 200},
+			},
+		},
+		{
+			name:     "404s use up the not-found budget",
+			notFound: "2/m",
+			steps: []step{
+				{path: "/missing", want: 404},
+				{path: "/missing", want: 404},
+				{path: "/missing", want: 429},
+				{path: "/ok", want: 429},
+				{path: "/ok", remote: "192.0.2.2", want: 200},
+			},
+		},
+		{
+			name:     "other responses don't",
+			notFound: "2/m",
+			steps: []step{
+				{path: "/ok", want: 200},
+				{path: "/ok", want: 200},
+				{path: "/empty", want: 200},
+				{path: "/empty", want: 200},
+				{path: "/missing", want: 404},
+				{path: "/missing", want: 404},
+				{path: "/missing", want: 429},
+			},
+		},
+		{
+			name:     "refused requests don't cost 404s",
+			limit:    "1/m",
+			notFound: "1/m",
+			steps: []step{
+				{path: "/ok", want: 200},
+				{path: "/missing", want: 429},
+				{path: "/missing", want: 429},
+			},
+		},
+		{
+			name:     "IPv6 clients share a /64",
+			notFound: "1/m",
+			steps: []step{
+				{path: "/missing", remote: "[2001:db8::1]:1", want: 404},
+				{path: "/missing", remote: "[2001:db8::2]:1", want: 429},
+				{path: "/missing", remote: "[2001:db8:0:1::1]:1", want: 404},
+			},
+		},
+		{
+			name:     "admins aren't limited",
+			limit:    "1/m",
+			notFound: "1/m",
+			steps: []step{
+				{path: "/missing", want: 404},
+				{path: "/missing", want: 429},
+				{path: "/missing", admin: true, want: 404},
+				{path: "/ok", admin: true, want: 200},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handlers{adminToken: "admin-token", notFoundLimit: mustRequestLimit(t, tt.notFound)}
+			handler := h.RateLimit(mustRequestLimit(t, tt.limit), limitTestHandler)
+			for i, s := range tt.steps {
+				r := httptest.NewRequest("GET", s.path, nil)
+				if s.remote != "" {
+					r.RemoteAddr = s.remote
+				}
+				if s.admin {
+					r.Header.Set("Authorization", "Bearer admin-token")
+				}
+				w := httptest.NewRecorder()
+				handler(w, r)
+				if w.Code != s.want {
+					t.Fatalf("step %d (%s): status %d, want %d", i, s.path, w.Code, s.want)
+				}
+			}
+		})
+	}
+}
+
+// TestRateLimitLongResponses checks that responses still being streamed
+// don't hold on to the not-found budget
+func TestRateLimitLongResponses(t *testing.T) {
+	h := &Handlers{notFoundLimit: mustRequestLimit(t, "2/m")}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := h.RateLimit(nil, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("the rest of a long download"))
+	})
+
+	const downloads = 5
+	var wg sync.WaitGroup
+	codes := make([]int, downloads)
+	for i := range downloads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "/ok", nil))
+			codes[i] = w.Code
+			if w.Code != http.StatusOK {
+				started <- struct{}{} // refused before the handler ran
+			}
+		}()
+	}
+	for range downloads {
+		<-started
+	}
+
+	// Every download is mid-body, and the 404 budget is still whole
+	for i := range 2 {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/missing", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("404 %d during downloads: status %d", i, w.Code)
+		}
+	}
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("download %d: status %d", i, code)
+		}
+	}
+}
+
+func TestLimitLogins(t *testing.T) {
+	h := &Handlers{}
+	handler := h.LimitLogins(mustRequestLimit(t, "2/m"), func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	tests := []struct {
+		method string
+		remote string
+		want   int
+	}{
+		{"GET", "", 200},
+		{"POST", "", 401},
+		{"GET", "", 200},
+		{"POST", "", 401},
+		{"POST", "", 429},
+		{"GET", "", 200},
+		{"POST", "192.0.2.2:1", 401},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/login", nil)
+		if tt.remote != "" {
+			r.RemoteAddr = tt.remote
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("request %d (%s): status %d, want %d", i, tt.method, w.Code, tt.want)
+		}
+	}
+}
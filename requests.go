@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zackgomez/kiss-drop/api"
+)
+
+// ErrRequestClosed is returned when a file request no longer accepts uploads
+var ErrRequestClosed = errors.New("file request is closed")
+
+// ErrRequestLimit is returned when an upload would exceed a file request's limits
+var ErrRequestLimit = errors.New("file request limit reached")
+
+// ErrExtensionNotAllowed is returned when a file request rejects a file type
+var ErrExtensionNotAllowed = errors.New("file type not allowed")
+
+// FileRequest is a link that lets anyone upload files on behalf of its creator
+type FileRequest struct {
+	ID                string     `json:"id"`
+	Label             string     `json:"label"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	MaxFiles          int        `json:"max_files,omitempty"`
+	MaxTotalSize      int64      `json:"max_total_size,omitempty"`
+	AllowedExtensions []string   `json:"allowed_extensions,omitempty"`
+	NotifyURL         string     `json:"notify_url,omitempty"`
+	ShareIDs          []string   `json:"share_ids"`
+	TotalSize         int64      `json:"total_size"`
+}
+
+// RequestLimits holds the optional restrictions on a file request
+type RequestLimits struct {
+	MaxFiles          int
+	MaxTotalSize      int64
+	AllowedExtensions []string
+}
+
+// RequestStore handles file request metadata
+type RequestStore struct {
+	dataDir string
+	mu      sync.Mutex
+}
+
+// NewRequestStore creates a new RequestStore instance
+func NewRequestStore(dataDir string) (*RequestStore, error) {
+	requestsDir := filepath.Join(dataDir, "requests")
+	if err := os.MkdirAll(requestsDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating requests directory: %w", err)
+	}
+	return &RequestStore{dataDir: dataDir}, nil
+}
+
+// requestPath returns the path to the JSON file for a request
+func (rs *RequestStore) requestPath(id string) string {
+	return filepath.Join(rs.dataDir, "requests", id+".json")
+}
+
+// normalizeExtensions lowercases extensions and makes sure they start with a dot
+func normalizeExtensions(exts []string) []string {
+	var out []string
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		out = append(out, ext)
+	}
+	return out
+}
+
+// CreateRequest creates a new file request
+func (rs *RequestStore) CreateRequest(label string, expiresAt *time.Time, limits RequestLimits, notifyURL string) (*FileRequest, error) {
+	id, err := GenerateID()
+	if err != nil {
+		return nil, fmt.Errorf("generating ID: %w", err)
+	}
+
+	req := &FileRequest{
+		ID:                id,
+		Label:             label,
+		CreatedAt:         time.Now().UTC(),
+		ExpiresAt:         expiresAt,
+		MaxFiles:          limits.MaxFiles,
+		MaxTotalSize:      limits.MaxTotalSize,
+		AllowedExtensions: normalizeExtensions(limits.AllowedExtensions),
+		NotifyURL:         notifyURL,
+		ShareIDs:          []string{},
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err := rs.save(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// GetRequest retrieves a file request, returning nil if it does not exist
+func (rs *RequestStore) GetRequest(id string) (*FileRequest, error) {
+	if !ValidID(id) {
+		return nil, nil
+	}
+	data, err := os.ReadFile(rs.requestPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+
+	var req FileRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("parsing request: %w", err)
+	}
+	return &req, nil
+}
+
+// ListRequests returns all file requests sorted by created_at descending
+func (rs *RequestStore) ListRequests() ([]*FileRequest, error) {
+	entries, err := os.ReadDir(filepath.Join(rs.dataDir, "requests"))
+	if err != nil {
+		return nil, fmt.Errorf("reading requests directory: %w", err)
+	}
+
+	requests := []*FileRequest{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		req, err := rs.GetRequest(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil || req == nil {
+			continue
+		}
+		requests = append(requests, req)
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].CreatedAt.After(requests[j].CreatedAt)
+	})
+	return requests, nil
+}
+
+// DeleteRequest removes a file request. Shares uploaded through it are kept.
+func (rs *RequestStore) DeleteRequest(id string) error {
+	if !ValidID(id) {
+		return ErrInvalidID
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	err := os.Remove(rs.requestPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// save writes a request to disk
+func (rs *RequestStore) save(req *FileRequest) error {
+	if !ValidID(req.ID) {
+		return ErrInvalidID
+	}
+	data, err := json.MarshalIndent(req, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding request: %w", err)
+	}
+	if err := writeFileAtomic(rs.requestPath(req.ID), data, 0644); err != nil {
+		return fmt.Errorf("writing request: %w", err)
+	}
+	return nil
+}
+
+// IsOpen reports whether the request has not expired and still has room for files
+func (req *FileRequest) IsOpen() bool {
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		return false
+	}
+	return req.MaxFiles <= 0 || len(req.ShareIDs) < req.MaxFiles
+}
+
+// CheckUpload reports whether a file of the given name and size may still be
+// uploaded to the request
+func (req *FileRequest) CheckUpload(fileName string, fileSize int64) error {
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		return ErrRequestClosed
+	}
+	return req.checkLimits(fileName, fileSize)
+}
+
+// checkLimits reports whether a file fits the request's count, size and
+// extension limits
+func (req *FileRequest) checkLimits(fileName string, fileSize int64) error {
+	if req.MaxFiles > 0 && len(req.ShareIDs) >= req.MaxFiles {
+		return ErrRequestLimit
+	}
+	if req.MaxTotalSize > 0 && req.TotalSize+fileSize > req.MaxTotalSize {
+		return ErrRequestLimit
+	}
+	if len(req.AllowedExtensions) > 0 {
+		ext := strings.ToLower(filepath.Ext(fileName))
+		allowed := false
+		for _, a := range req.AllowedExtensions {
+			if ext == a {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrExtensionNotAllowed
+		}
+	}
+	return nil
+}
+
+// AttachShare records a finished upload against a request. The limits are
+// checked again under the lock since several uploads may finish at once,
+// but not the expiry: that was checked when the upload was accepted, and a
+// slow finalize shouldn't lose a file the uploader was told was received.
+func (rs *RequestStore) AttachShare(id string, meta *ShareMeta) (*FileRequest, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	req, err := rs.GetRequest(id)
+	if err != nil {
+		return nil, err
+	}
+	if req == nil {
+		return nil, ErrRequestClosed
+	}
+	if err := req.checkLimits(meta.FileName, meta.FileSize); err != nil {
+		return nil, err
+	}
+
+	req.ShareIDs = append(req.ShareIDs, meta.ID)
+	req.TotalSize += meta.FileSize
+	if err := rs.save(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// requestNotification is the JSON body posted to a request's notify URL
+type requestNotification struct {
+	RequestID string            `json:"requestId"`
+	Label     string            `json:"label"`
+	Share     api.ShareListItem `json:"share"`
+}
+
+// notifyRequest posts a new upload to the request's webhook in the background
+func notifyRequest(req *FileRequest, item api.ShareListItem) {
+	if req.NotifyURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(requestNotification{
+		RequestID: req.ID,
+		Label:     req.Label,
+		Share:     item,
+	})
+	if err != nil {
+		log.Printf("Error encoding request notification: %v", err)
+		return
+	}
+
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(req.NotifyURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error notifying request %s: %v", req.ID, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Request %s notification returned %s", req.ID, resp.Status)
+		}
+	}()
+}
+
+// requestErrorStatus maps a file request error to an HTTP status code
+func requestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrRequestClosed):
+		return http.StatusGone
+	case errors.Is(err, ErrRequestLimit):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrExtensionNotAllowed):
+		return http.StatusUnsupportedMediaType
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// checkRequestUpload verifies an upload is allowed by its file request, writing an error if not
+func (h *Handlers) checkRequestUpload(w http.ResponseWriter, requestID, fileName string, fileSize int64) bool {
+	req, err := h.requests.GetRequest(requestID)
+	if err != nil {
+		log.Printf("Error getting request: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	if req == nil {
+		http.Error(w, "File request not found", http.StatusNotFound)
+		return false
+	}
+	if err := req.CheckUpload(fileName, fileSize); err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return false
+	}
+	return true
+}
+
+// linkRequestShare adds a new share to its file request and notifies the
+// creator. If the request filled up or was deleted in the meantime the share
+// is removed; chunked uploads report this through their finalize job.
+func (h *Handlers) linkRequestShare(meta *ShareMeta) error {
+	req, err := h.requests.AttachShare(meta.RequestID, meta)
+	if err != nil {
+		h.storage.DeleteShare(meta.ID)
+		return err
+	}
+
+	notifyRequest(req, h.shareListItem(meta))
+	return nil
+}
+
+// FileRequestResponse is the JSON response for a file request
+type FileRequestResponse struct {
+	ID                string              `json:"id"`
+	URL               string              `json:"url"`
+	Label             string              `json:"label"`
+	CreatedAt         string              `json:"createdAt"`
+	ExpiresAt         *string             `json:"expiresAt,omitempty"`
+	MaxFiles          int                 `json:"maxFiles,omitempty"`
+	MaxTotalSize      int64               `json:"maxTotalSize,omitempty"`
+	AllowedExtensions []string            `json:"allowedExtensions,omitempty"`
+	NotifyURL         string              `json:"notifyUrl,omitempty"`
+	FileCount         int                 `json:"fileCount"`
+	TotalSize         int64               `json:"totalSize"`
+	Shares            []api.ShareListItem `json:"shares,omitempty"`
+}
+
+// requestResponse converts a file request to its response format
+func (h *Handlers) requestResponse(req *FileRequest) FileRequestResponse {
+	resp := FileRequestResponse{
+		ID:                req.ID,
+		URL:               h.baseURL + "/r/" + req.ID,
+		Label:             req.Label,
+		CreatedAt:         req.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		MaxFiles:          req.MaxFiles,
+		MaxTotalSize:      req.MaxTotalSize,
+		AllowedExtensions: req.AllowedExtensions,
+		NotifyURL:         req.NotifyURL,
+		FileCount:         len(req.ShareIDs),
+		TotalSize:         req.TotalSize,
+	}
+	if req.ExpiresAt != nil {
+		exp := req.ExpiresAt.Format("2006-01-02T15:04:05Z")
+		resp.ExpiresAt = &exp
+	}
+	return resp
+}
+
+// HandleRequests handles GET and POST /api/requests
+func (h *Handlers) HandleRequests(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		requests, err := h.requests.ListRequests()
+		if err != nil {
+			log.Printf("Error listing requests: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		items := make([]FileRequestResponse, 0, len(requests))
+		for _, req := range requests {
+			items = append(items, h.requestResponse(req))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+
+	case http.MethodPost:
+		var body struct {
+			Label             string   `json:"label"`
+			ExpiresIn         string   `json:"expiresIn,omitempty"`
+			MaxFiles          int      `json:"maxFiles,omitempty"`
+			MaxTotalSize      int64    `json:"maxTotalSize,omitempty"`
+			AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+			NotifyURL         string   `json:"notifyUrl,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if body.Label == "" {
+			http.Error(w, "label is required", http.StatusBadRequest)
+			return
+		}
+		if body.MaxFiles < 0 || body.MaxTotalSize < 0 {
+			http.Error(w, "Limits must not be negative", http.StatusBadRequest)
+			return
+		}
+		if body.NotifyURL != "" && !strings.HasPrefix(body.NotifyURL, "http://") && !strings.HasPrefix(body.NotifyURL, "https://") {
+			http.Error(w, "notifyUrl must be an http(s) URL", http.StatusBadRequest)
+			return
+		}
+
+		limits := RequestLimits{
+			MaxFiles:          body.MaxFiles,
+			MaxTotalSize:      body.MaxTotalSize,
+			AllowedExtensions: body.AllowedExtensions,
+		}
+		req, err := h.requests.CreateRequest(body.Label, h.expiresAt(body.ExpiresIn), limits, body.NotifyURL)
+		if err != nil {
+			log.Printf("Error creating request: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(h.requestResponse(req))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleRequest handles GET and DELETE /api/requests/:id
+func (h *Handlers) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/requests/")
+	if !ValidID(id) {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		req, err := h.requests.GetRequest(id)
+		if err != nil {
+			log.Printf("Error getting request: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if req == nil {
+			http.Error(w, "File request not found", http.StatusNotFound)
+			return
+		}
+
+		resp := h.requestResponse(req)
+		resp.Shares = []api.ShareListItem{}
+		for _, shareID := range req.ShareIDs {
+			meta, err := h.storage.GetShare(shareID)
+			if err != nil || meta == nil {
+				continue // Expired or deleted since upload
+			}
+			resp.Shares = append(resp.Shares, h.shareListItem(meta))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+	case http.MethodDelete:
+		if err := h.requests.DeleteRequest(id); err != nil {
+			log.Printf("Error deleting request: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFileRequestCheckUpload(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name     string
+		req      FileRequest
+		fileName string
+		size     int64
+		want     error // from CheckUpload
+		attach   error // from checkLimits, used once the upload is accepted
+	}{
+		{"open", FileRequest{}, "a.pdf", 10, nil, nil},
+		{"expired", FileRequest{ExpiresAt: &past}, "a.pdf", 10, ErrRequestClosed, nil},
+		{"full", FileRequest{MaxFiles: 1, ShareIDs: []string{"x"}}, "a.pdf", 10, ErrRequestLimit, ErrRequestLimit},
+		{"too large", FileRequest{MaxTotalSize: 100, TotalSize: 95}, "a.pdf", 10, ErrRequestLimit, ErrRequestLimit},
+		{"extension", FileRequest{AllowedExtensions: []string{".pdf"}}, "a.PDF", 10, nil, nil},
+		{"wrong extension", FileRequest{AllowedExtensions: []string{".pdf"}}, "a.exe", 10, ErrExtensionNotAllowed, ErrExtensionNotAllowed},
+	}
+	for _, tt := range tests {
+		if err := tt.req.CheckUpload(tt.fileName, tt.size); !errors.Is(err, tt.want) {
+			t.Errorf("%s: CheckUpload = %v, want %v", tt.name, err, tt.want)
+		}
+		if err := tt.req.checkLimits(tt.fileName, tt.size); !errors.Is(err, tt.attach) {
+			t.Errorf("%s: checkLimits = %v, want %v", tt.name, err, tt.attach)
+		}
+	}
+}
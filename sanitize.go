@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errNotStrippable means the file isn't in a format we know how to rewrite
+var errNotStrippable = errors.New("unsupported format")
+
+// maxWebPStripSize bounds WebP files, which are rewritten in memory
+const maxWebPStripSize = 64 << 20
+
+// stripMetadata removes EXIF, XMP and IPTC metadata from a JPEG, PNG or WebP
+// file in place, without re-encoding the image data. It reports whether the
+// file was rewritten.
+func stripMetadata(path, detectedType string) (bool, error) {
+	var strip func(io.Reader, io.Writer) error
+	switch strings.SplitN(detectedType, ";", 2)[0] {
+	case "image/jpeg":
+		strip = stripJPEG
+	case "image/png":
+		strip = stripPNG
+	case "image/webp":
+		strip = stripWebP
+	default:
+		return false, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	tmp := path + ".strip"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	w := bufio.NewWriter(dst)
+
+	err = strip(bufio.NewReader(src), w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// stripJPEG drops APP1 (EXIF, XMP) and APP13 (IPTC) segments. The EXIF
+// orientation is carried over in a minimal APP1 so photos don't turn sideways.
+func stripJPEG(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return errNotStrippable
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+
+	orientationWritten := false
+	for {
+		// Markers may be preceded by any number of 0xFF fill bytes
+		b, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("reading marker: %w", err)
+		}
+		if b != 0xFF {
+			return fmt.Errorf("expected marker, got 0x%02x", b)
+		}
+		marker := byte(0xFF)
+		for marker == 0xFF {
+			if marker, err = br.ReadByte(); err != nil {
+				return fmt.Errorf("reading marker: %w", err)
+			}
+		}
+
+		// Standalone markers have no length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+		if marker == 0xD9 { // EOI
+			_, err := w.Write([]byte{0xFF, marker})
+			return err
+		}
+
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(br, lenBuf[:]); err != nil {
+			return fmt.Errorf("reading segment length: %w", err)
+		}
+		length := int(binary.BigEndian.Uint16(lenBuf[:]))
+		if length < 2 {
+			return fmt.Errorf("invalid segment length %d", length)
+		}
+		payload := make([]byte, length-2)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return fmt.Errorf("reading segment: %w", err)
+		}
+
+		switch {
+		case marker == 0xE1: // APP1: EXIF or XMP
+			if o := exifOrientation(payload); o > 1 && !orientationWritten {
+				if _, err := w.Write(orientationSegment(o)); err != nil {
+					return err
+				}
+				orientationWritten = true
+			}
+			continue
+		case marker == 0xED: // APP13: Photoshop IRB / IPTC
+			continue
+		}
+
+		if _, err := w.Write([]byte{0xFF, marker, lenBuf[0], lenBuf[1]}); err != nil {
+			return err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+
+		// Start of scan: the rest is entropy-coded data we keep as is
+		if marker == 0xDA {
+			_, err := io.Copy(w, br)
+			return err
+		}
+	}
+}
+
+// exifOrientation returns the orientation tag from an EXIF APP1 payload, or 0
+func exifOrientation(payload []byte) int {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// orientationSegment builds an APP1 segment holding only an orientation tag
+func orientationSegment(orientation int) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xE1, 0x00, 0x22}) // marker, length 34
+	b.WriteString("Exif\x00\x00")
+	b.WriteString("MM\x00\x2A")                    // big-endian TIFF header
+	b.Write([]byte{0x00, 0x00, 0x00, 0x08})        // IFD0 offset
+	b.Write([]byte{0x00, 0x01})                    // one entry
+	b.Write([]byte{0x01, 0x12, 0x00, 0x03})        // orientation, SHORT
+	b.Write([]byte{0x00, 0x00, 0x00, 0x01})        // count
+	b.Write([]byte{0x00, byte(orientation), 0, 0}) // value
+	b.Write([]byte{0x00, 0x00, 0x00, 0x00})        // no next IFD
+	return b.Bytes()
+}
+
+// pngMetadataChunks are the ancillary PNG chunks that carry metadata. XMP is
+// stored in iTXt.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+// stripPNG drops metadata chunks from a PNG stream
+func stripPNG(r io.Reader, w io.Writer) error {
+	sig := make([]byte, 8)
+	if _, err := io.ReadFull(r, sig); err != nil || string(sig) != "\x89PNG\r\n\x1a\n" {
+		return errNotStrippable
+	}
+	if _, err := w.Write(sig); err != nil {
+		return err
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return fmt.Errorf("reading chunk header: %w", err)
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+
+		// Data plus the trailing CRC
+		body := io.LimitReader(r, length+4)
+		if pngMetadataChunks[chunkType] {
+			if _, err := io.Copy(io.Discard, body); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if n, err := io.Copy(w, body); err != nil {
+			return err
+		} else if n != length+4 {
+			return fmt.Errorf("truncated %s chunk", chunkType)
+		}
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
+
+// stripWebP drops the EXIF and XMP chunks from a WebP file and clears the
+// matching flags in its VP8X header
+func stripWebP(r io.Reader, w io.Writer) error {
+	data, err := io.ReadAll(io.LimitReader(r, maxWebPStripSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxWebPStripSize {
+		return fmt.Errorf("file too large to rewrite")
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return errNotStrippable
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString("RIFF\x00\x00\x00\x00WEBP")
+
+	for pos := 12; pos < len(data); {
+		if pos+8 > len(data) {
+			return fmt.Errorf("truncated chunk header")
+		}
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		end := pos + 8 + size + size%2 // chunks are padded to even sizes
+		if size < 0 || end > len(data) {
+			return fmt.Errorf("truncated %s chunk", fourCC)
+		}
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+			// dropped
+		case "VP8X":
+			chunk := append([]byte(nil), data[pos:end]...)
+			if size > 0 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP present flags
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(result)-8))
+	_, err = w.Write(result)
+	return err
+}
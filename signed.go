@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSignedLinkTTL is how long a signed link lasts when no expiry is given
+const defaultSignedLinkTTL = 24 * time.Hour
+
+// RotateSignNonce gives a share a new signing nonce, which invalidates every
+// signed link minted for it so far
+func (s *Storage) RotateSignNonce(id string) (*ShareMeta, error) {
+	nonce, err := GenerateToken()
+	if err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	unlock, err := s.lockShare(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	meta, err := s.GetShare(id)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("share %s not found", id)
+	}
+	meta.SignNonce = nonce
+	if err := s.saveMeta(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// signDownload computes the signature of a download link for a share,
+// optional version and expiry (unix seconds)
+func (h *Handlers) signDownload(meta *ShareMeta, version string, exp int64) string {
+	mac := hmac.New(sha256.New, h.signingSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", meta.ID, version, exp, meta.SignNonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignedLink verifies the exp and sig parameters of a download link.
+// Unsigned requests pass with signed=false; for a bad or expired signature
+// it writes an error and returns ok=false. A signed link only grants access,
+// so it restricts nothing unless anonymous downloads are off.
+func (h *Handlers) checkSignedLink(w http.ResponseWriter, r *http.Request, meta *ShareMeta) (signed, ok bool) {
+	q := r.URL.Query()
+	sig, expStr := q.Get("sig"), q.Get("exp")
+	if sig == "" && expStr == "" {
+		return false, true
+	}
+
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	valid := err == nil && len(h.signingSecret) > 0 && meta.SignNonce != "" &&
+		hmac.Equal([]byte(sig), []byte(h.signDownload(meta, q.Get("v"), exp)))
+	result := "ok"
+	switch {
+	case !valid:
+		result = "invalid"
+	case time.Now().Unix() > exp:
+		result = "expired"
+	}
+	h.audit(r, AuditEvent{Event: AuditUnlock, ShareID: meta.ID, Result: result})
+	if result != "ok" {
+		http.Error(w, "Link expired or invalid", http.StatusForbidden)
+		return true, false
+	}
+	return true, true
+}
+
+// SignedLinkResponse is the JSON response for a newly minted signed link
+type SignedLinkResponse struct {
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// HandleSignedLinks handles /api/share/:id/signed-links for the share's
+// owner or an admin. POST mints a time-limited download link; DELETE revokes
+// all links minted so far.
+func (h *Handlers) HandleSignedLinks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/share/")
+	id := strings.TrimSuffix(path, "/signed-links")
+	if !ValidID(id) {
+		http.Error(w, "Invalid share ID", http.StatusBadRequest)
+		return
+	}
+
+	if len(h.signingSecret) == 0 {
+		http.Error(w, "Signed links disabled", http.StatusForbidden)
+		return
+	}
+	if !h.checkCanManage(w, r, id) {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if _, err := h.storage.RotateSignNonce(id); err != nil {
+			log.Printf("Error revoking signed links: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		h.audit(r, AuditEvent{Event: AuditLinksRevoked, ShareID: id, Actor: h.manageActor(r)})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req struct {
+		ExpiresIn string `json:"expiresIn,omitempty"` // Go duration, e.g. "15m"
+		Version   int    `json:"version,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ttl := defaultSignedLinkTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid expiresIn", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	meta, err := h.storage.GetShare(id)
+	if err != nil || meta == nil {
+		log.Printf("Error getting share: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if req.Version != 0 && meta.FindVersion(req.Version) == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if meta.SignNonce == "" {
+		if meta, err = h.storage.RotateSignNonce(id); err != nil {
+			log.Printf("Error creating signing nonce: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// A link never outlives its share
+	expiresAt := time.Now().Add(ttl)
+	if meta.ExpiresAt != nil && meta.ExpiresAt.Before(expiresAt) {
+		expiresAt = *meta.ExpiresAt
+	}
+	exp := expiresAt.Unix()
+
+	version := ""
+	params := url.Values{}
+	if req.Version != 0 {
+		version = strconv.Itoa(req.Version)
+		params.Set("v", version)
+	}
+	params.Set("exp", strconv.FormatInt(exp, 10))
+	params.Set("sig", h.signDownload(meta, version, exp))
+
+	h.audit(r, AuditEvent{
+		Event:   AuditLinkSigned,
+		ShareID: meta.ID,
+		Version: req.Version,
+		Actor:   h.manageActor(r),
+		Detail:  "expires " + time.Unix(exp, 0).UTC().Format("2006-01-02T15:04:05Z"),
+	})
+
+	response := SignedLinkResponse{
+		URL:       h.baseURL + "/api/share/" + meta.ID + "/download?" + params.Encode(),
+		ExpiresAt: time.Unix(exp, 0).UTC().Format("2006-01-02T15:04:05Z"),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,13 +1,18 @@
 // Chunked upload handling for kiss-drop
 
 const CHUNK_SIZE = 5 * 1024 * 1024; // 5MB chunks - must match server
+const FINALIZE_POLL_INTERVAL = 1000; // ms between finalize status checks
 
 class ChunkedUploader {
     constructor(file, options = {}) {
         this.file = file;
         this.expiresIn = options.expiresIn || 'default';
+        this.requestId = options.requestId || '';
+        this.keepMetadata = options.keepMetadata || false;
+        this.private = options.private || false;
         this.onProgress = options.onProgress || (() => {});
         this.onComplete = options.onComplete || (() => {});
+        this.onFinalizing = options.onFinalizing || (() => {});
         this.onError = options.onError || (() => {});
 
         this.uploadId = null;
@@ -26,12 +31,16 @@ class ChunkedUploader {
                 body: JSON.stringify({
                     fileName: this.file.name,
                     fileSize: this.file.size,
-                    expiresIn: this.expiresIn
+                    expiresIn: this.expiresIn,
+                    requestId: this.requestId || undefined,
+                    keepMetadata: this.keepMetadata || undefined,
+                    private: this.private || undefined
                 })
             });
 
             if (!initResponse.ok) {
-                throw new Error('Failed to initialize upload');
+                const message = await initResponse.text();
+                throw new Error(message.trim() || 'Failed to initialize upload');
             }
 
             const initData = await initResponse.json();
@@ -56,7 +65,21 @@ class ChunkedUploader {
                 throw new Error('Failed to complete upload');
             }
 
-            const result = await completeResponse.json();
+            // The server assembles large files in the background
+            let result = await completeResponse.json();
+            while (result.status === 'running') {
+                this.onFinalizing(result.bytesProcessed, result.totalBytes);
+                await new Promise(resolve => setTimeout(resolve, FINALIZE_POLL_INTERVAL));
+                const statusResponse = await fetch(result.statusUrl);
+                if (!statusResponse.ok) {
+                    throw new Error('Failed to get upload status');
+                }
+                result = await statusResponse.json();
+            }
+            if (result.status === 'failed') {
+                throw new Error(result.error || 'Failed to complete upload');
+            }
+            result.manageToken = initData.manageToken;
             this.onComplete(result);
 
         } catch (error) {
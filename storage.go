@@ -2,52 +2,181 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
-// ShareMeta holds metadata for a shared file
+// ShareMeta holds metadata for a shared file. The top-level file fields
+// describe the latest version; older versions are kept in Versions.
 type ShareMeta struct {
-	ID          string     `json:"id"`
-	CreatedAt   time.Time  `json:"created_at"`
-	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
-	FileName    string     `json:"file_name"`
-	FileSize    int64      `json:"file_size"`
-	UploaderIP  string     `json:"uploader_ip,omitempty"`
-	UserAgent   string     `json:"user_agent,omitempty"`
-	ContentType string     `json:"content_type,omitempty"`
+	ID              string     `json:"id"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	FileName        string     `json:"file_name"`
+	FileSize        int64      `json:"file_size"`
+	SHA256          string     `json:"sha256,omitempty"`
+	UploaderIP      string     `json:"uploader_ip,omitempty"`
+	UserAgent       string     `json:"user_agent,omitempty"`
+	ContentType     string     `json:"content_type,omitempty"`
+	DetectedType    string     `json:"detected_type,omitempty"`
+	Stripped        bool       `json:"metadata_stripped,omitempty"`
+	HasThumbnail    bool       `json:"has_thumbnail,omitempty"`
+	RequestID       string     `json:"request_id,omitempty"`
+	ManageTokenHash string     `json:"manage_token_hash,omitempty"`
+	SignNonce       string     `json:"sign_nonce,omitempty"`
+	Private         bool       `json:"private,omitempty"`
+	OwnerID         string     `json:"owner_id,omitempty"`
+	Version         int        `json:"version,omitempty"`
+	UpdatedAt       *time.Time `json:"updated_at,omitempty"`
+	// ModifiedAt is the last change of any kind, such as a new expiry
+	ModifiedAt *time.Time     `json:"modified_at,omitempty"`
+	Versions   []ShareVersion `json:"versions,omitempty"`
+}
+
+// ShareVersion describes a previous version of a share's file
+type ShareVersion struct {
+	Version      int       `json:"version"`
+	FileName     string    `json:"file_name"`
+	FileSize     int64     `json:"file_size"`
+	SHA256       string    `json:"sha256,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	DetectedType string    `json:"detected_type,omitempty"`
+	Stripped     bool      `json:"metadata_stripped,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// CurrentVersion returns the version number of the latest file (1 for shares
+// that predate versioning)
+func (m *ShareMeta) CurrentVersion() int {
+	if m.Version == 0 {
+		return 1
+	}
+	return m.Version
+}
+
+// LastModified returns when the share's metadata last changed, for
+// Last-Modified headers
+func (m *ShareMeta) LastModified() time.Time {
+	if m.ModifiedAt != nil {
+		return *m.ModifiedAt
+	}
+	return m.LatestVersion().CreatedAt
+}
+
+// LatestVersion describes the current file as a ShareVersion
+func (m *ShareMeta) LatestVersion() ShareVersion {
+	createdAt := m.CreatedAt
+	if m.UpdatedAt != nil {
+		createdAt = *m.UpdatedAt
+	}
+	return ShareVersion{
+		Version:      m.CurrentVersion(),
+		FileName:     m.FileName,
+		FileSize:     m.FileSize,
+		SHA256:       m.SHA256,
+		ContentType:  m.ContentType,
+		DetectedType: m.DetectedType,
+		Stripped:     m.Stripped,
+		CreatedAt:    createdAt,
+	}
+}
+
+// FindVersion returns the given version of the file, or nil if it is not kept
+func (m *ShareMeta) FindVersion(version int) *ShareVersion {
+	if version == m.CurrentVersion() {
+		latest := m.LatestVersion()
+		return &latest
+	}
+	for i := range m.Versions {
+		if m.Versions[i].Version == version {
+			return &m.Versions[i]
+		}
+	}
+	return nil
+}
+
+// StorageOptions configures how shares are stored
+type StorageOptions struct {
+	// MaxVersions is the number of old versions kept per share (0 = unlimited)
+	MaxVersions int
+	// StripMetadata removes EXIF/XMP/IPTC from images unless the upload opts out
+	StripMetadata bool
+	// IDs generates share IDs (random base62 when nil)
+	IDs *IDGenerator
+	// Audit records shares removed by the expiry cleanup
+	Audit *AuditLog
 }
 
 // Storage handles file and metadata operations
 type Storage struct {
 	dataDir string
+	opts    StorageOptions
+	ids     *IDGenerator
+	mu      sync.Mutex // serializes metadata updates to existing shares
+
+	historyMu sync.Mutex
+	history   []CleanupRun // most recent cleanup runs, oldest first
 }
 
 // NewStorage creates a new Storage instance
-func NewStorage(dataDir string) (*Storage, error) {
+func NewStorage(dataDir string, opts StorageOptions) (*Storage, error) {
 	sharesDir := filepath.Join(dataDir, "shares")
 	if err := os.MkdirAll(sharesDir, 0755); err != nil {
 		return nil, fmt.Errorf("creating shares directory: %w", err)
 	}
-	return &Storage{dataDir: dataDir}, nil
+	ids := opts.IDs
+	if ids == nil {
+		var err error
+		if ids, err = NewIDGenerator(IDSchemeRandom, 0, ""); err != nil {
+			return nil, err
+		}
+	}
+	return &Storage{dataDir: dataDir, opts: opts, ids: ids}, nil
+}
+
+// StripsMetadata reports whether image metadata is removed by default
+func (s *Storage) StripsMetadata() bool {
+	return s.opts.StripMetadata
+}
+
+// reservedNames are file names used inside share directories for our own data
+var reservedNames = map[string]bool{
+	"meta.json":      true,
+	"versions":       true,
+	thumbName:        true,
+	archiveIndexName: true,
 }
 
-// GenerateID creates a random 8-character ID using base62
-func GenerateID() (string, error) {
-	const alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-	bytes := make([]byte, 8)
-	if _, err := rand.Read(bytes); err != nil {
+// IsReservedName reports whether a file name would collide with share internals
+func IsReservedName(name string) bool {
+	return reservedNames[name]
+}
+
+// GenerateToken creates a random secret token, hex encoded
+func GenerateToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
-	for i := range bytes {
-		bytes[i] = alphabet[bytes[i]%62]
-	}
-	return string(bytes), nil
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the hex SHA-256 of a secret token for storage
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 // shareDir returns the directory path for a share
@@ -65,53 +194,128 @@ func (s *Storage) filePath(id, fileName string) string {
 	return filepath.Join(s.shareDir(id), fileName)
 }
 
+// versionDir returns the directory holding a previous version's file
+func (s *Storage) versionDir(id string, version int) string {
+	return filepath.Join(s.shareDir(id), "versions", strconv.Itoa(version))
+}
+
+// allocateID claims a share directory under a new ID. os.Mkdir fails if
+// the directory exists, so a colliding ID is detected atomically and another
+// one is tried. A requested slug is used as is or fails with ErrIDTaken.
+func (s *Storage) allocateID(slug string) (string, error) {
+	if slug != "" {
+		if err := ValidateSlug(slug); err != nil {
+			return "", err
+		}
+		if err := os.Mkdir(s.shareDir(slug), 0755); err != nil {
+			if os.IsExist(err) {
+				return "", ErrIDTaken
+			}
+			return "", fmt.Errorf("creating share directory: %w", err)
+		}
+		return slug, nil
+	}
+
+	for i := 0; i < idAttempts; i++ {
+		id, err := s.ids.Generate()
+		if err != nil {
+			return "", fmt.Errorf("generating ID: %w", err)
+		}
+		err = os.Mkdir(s.shareDir(id), 0755)
+		if err == nil {
+			return id, nil
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("creating share directory: %w", err)
+		}
+	}
+	return "", fmt.Errorf("no free share ID after %d attempts", idAttempts)
+}
+
+// ShareExists reports whether a share directory exists for an ID
+func (s *Storage) ShareExists(id string) bool {
+	if !ValidID(id) {
+		return false
+	}
+	_, err := os.Stat(s.shareDir(id))
+	return err == nil
+}
+
 // UploadInfo holds request metadata for a file upload
 type UploadInfo struct {
 	UploaderIP  string
 	UserAgent   string
 	ContentType string
+	RequestID   string
+	// ManageTokenHash authorizes later changes to the share, such as new versions
+	ManageTokenHash string
+	// ShareID is set when the upload is a new version of an existing share
+	ShareID string
+	// KeepMetadata opts out of stripping image metadata
+	KeepMetadata bool
+	// Slug requests a specific share ID instead of a generated one
+	Slug string
+	// Private keeps the share out of link previews
+	Private bool
+	// OwnerID is the account uploading the file, if signed in
+	OwnerID string
+	// Actor is who started the upload, for the audit log
+	Actor string
 }
 
 // CreateShare creates a new share with the given file
 func (s *Storage) CreateShare(file io.Reader, fileName string, fileSize int64, expiresAt *time.Time, info *UploadInfo) (*ShareMeta, error) {
-	id, err := GenerateID()
+	slug := ""
+	if info != nil {
+		slug = info.Slug
+	}
+	id, err := s.allocateID(slug)
 	if err != nil {
-		return nil, fmt.Errorf("generating ID: %w", err)
+		return nil, err
 	}
-
-	// Create share directory
 	dir := s.shareDir(id)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("creating share directory: %w", err)
-	}
 
 	// Save the file
 	filePath := s.filePath(id, fileName)
-	dst, err := os.Create(filePath)
+	written, hash, err := writeFile(filePath, file)
 	if err != nil {
 		os.RemoveAll(dir)
-		return nil, fmt.Errorf("creating file: %w", err)
+		return nil, err
 	}
-	defer dst.Close()
+	detected := detectContentType(filePath, fileName)
 
-	written, err := io.Copy(dst, file)
-	if err != nil {
-		os.RemoveAll(dir)
-		return nil, fmt.Errorf("writing file: %w", err)
+	stripped := false
+	if s.opts.StripMetadata && (info == nil || !info.KeepMetadata) {
+		if stripped, written, hash, err = s.sanitize(filePath, detected); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
 	}
 
 	// Create metadata
 	meta := &ShareMeta{
-		ID:        id,
-		CreatedAt: time.Now().UTC(),
-		ExpiresAt: expiresAt,
-		FileName:  fileName,
-		FileSize:  written,
+		ID:           id,
+		CreatedAt:    time.Now().UTC(),
+		ExpiresAt:    expiresAt,
+		FileName:     fileName,
+		FileSize:     written,
+		SHA256:       hash,
+		DetectedType: detected,
+		Stripped:     stripped,
+		Version:      1,
 	}
 	if info != nil {
 		meta.UploaderIP = info.UploaderIP
 		meta.UserAgent = info.UserAgent
 		meta.ContentType = info.ContentType
+		meta.RequestID = info.RequestID
+		meta.ManageTokenHash = info.ManageTokenHash
+		meta.Private = info.Private
+		meta.OwnerID = info.OwnerID
+	}
+
+	if err := saveArchiveIndex(dir, buildArchiveIndex(filePath)); err != nil {
+		log.Printf("Error saving archive index for %s: %v", id, err)
 	}
 
 	// Save metadata
@@ -119,12 +323,175 @@ func (s *Storage) CreateShare(file io.Reader, fileName string, fileSize int64, e
 		os.RemoveAll(dir)
 		return nil, err
 	}
+	s.queueThumbnail(meta)
 
 	return meta, nil
 }
 
+// writeFile copies r into a new file at path, returning its size and SHA-256
+func writeFile(path string, r io.Reader) (int64, string, error) {
+	dst, err := os.Create(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("creating file: %w", err)
+	}
+	defer dst.Close()
+
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(dst, h), r)
+	if err != nil {
+		return 0, "", fmt.Errorf("writing file: %w", err)
+	}
+	return written, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sanitize strips image metadata from a file, returning whether it changed
+// along with its new size and hash. Files we can't parse are left untouched.
+func (s *Storage) sanitize(path, detectedType string) (bool, int64, string, error) {
+	stripped, err := stripMetadata(path, detectedType)
+	if err != nil {
+		log.Printf("Not stripping metadata from %s: %v", path, err)
+		stripped = false
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, 0, "", fmt.Errorf("opening file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return false, 0, "", fmt.Errorf("hashing file: %w", err)
+	}
+	return stripped, size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// AddVersion replaces the file behind an existing share. The previous file is
+// moved into versions/N/ and the oldest versions beyond the retention limit
+// are removed.
+func (s *Storage) AddVersion(id string, file io.Reader, fileName string, info *UploadInfo) (*ShareMeta, error) {
+	if !ValidID(id) {
+		return nil, ErrInvalidID
+	}
+
+	// Write the new file before taking the lock, it may take a while
+	tmp, err := os.CreateTemp(s.shareDir(id), ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	written, hash, err := writeFile(tmpPath, file)
+	if err != nil {
+		return nil, err
+	}
+	detected := detectContentType(tmpPath, fileName)
+
+	stripped := false
+	if s.opts.StripMetadata && (info == nil || !info.KeepMetadata) {
+		if stripped, written, hash, err = s.sanitize(tmpPath, detected); err != nil {
+			return nil, err
+		}
+	}
+	archive := buildArchiveIndex(tmpPath)
+
+	unlock, err := s.lockShare(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	meta, err := s.GetShare(id)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, ErrShareNotFound
+	}
+
+	// Move the current file aside. Until the new metadata is saved, any
+	// failure puts it back so the share keeps working as before.
+	previous := meta.LatestVersion()
+	prevDir := s.versionDir(id, previous.Version)
+	curPath, prevPath := s.filePath(id, meta.FileName), filepath.Join(prevDir, meta.FileName)
+	curIndex, prevIndex := filepath.Join(s.shareDir(id), archiveIndexName), filepath.Join(prevDir, archiveIndexName)
+	newPath := s.filePath(id, fileName)
+	if err := os.MkdirAll(prevDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating version directory: %w", err)
+	}
+	if err := os.Rename(curPath, prevPath); err != nil {
+		os.Remove(prevDir)
+		return nil, fmt.Errorf("moving previous version: %w", err)
+	}
+	rollback := func() {
+		if newPath != curPath {
+			os.Remove(newPath)
+		}
+		os.Rename(prevPath, curPath)
+		os.Remove(curIndex)
+		os.Rename(prevIndex, curIndex)
+		os.Remove(prevDir)
+	}
+
+	// The archive listing, if any, moves with its file
+	if err := os.Rename(curIndex, prevIndex); err != nil && !os.IsNotExist(err) {
+		rollback()
+		return nil, fmt.Errorf("moving previous archive index: %w", err)
+	}
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		rollback()
+		return nil, fmt.Errorf("saving new version: %w", err)
+	}
+
+	now := time.Now().UTC()
+	meta.Versions = append(meta.Versions, previous)
+	meta.Version = previous.Version + 1
+	meta.UpdatedAt = &now
+	meta.FileName = fileName
+	meta.FileSize = written
+	meta.SHA256 = hash
+	meta.ContentType = ""
+	if info != nil {
+		meta.ContentType = info.ContentType
+	}
+	meta.DetectedType = detected
+	meta.Stripped = stripped
+
+	// The old thumbnail belongs to the previous version; the new one is
+	// generated once the version is saved
+	meta.HasThumbnail = false
+	if err := saveArchiveIndex(s.shareDir(id), archive); err != nil {
+		log.Printf("Error saving archive index for %s: %v", id, err)
+	}
+
+	// Apply the retention limit, oldest first; the files go once the
+	// metadata no longer lists them
+	var dropped []ShareVersion
+	for s.opts.MaxVersions > 0 && len(meta.Versions) > s.opts.MaxVersions {
+		dropped = append(dropped, meta.Versions[0])
+		meta.Versions = meta.Versions[1:]
+	}
+
+	if err := s.saveMeta(meta); err != nil {
+		rollback()
+		return nil, err
+	}
+	for _, v := range dropped {
+		os.RemoveAll(s.versionDir(id, v.Version))
+	}
+	os.Remove(s.thumbPath(id))
+	s.queueThumbnail(meta)
+	return meta, nil
+}
+
 // GetShare retrieves metadata for a share
 func (s *Storage) GetShare(id string) (*ShareMeta, error) {
+	if !ValidID(id) {
+		return nil, nil
+	}
 	data, err := os.ReadFile(s.metaPath(id))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -146,36 +513,158 @@ func (s *Storage) GetFilePath(id, fileName string) string {
 	return s.filePath(id, fileName)
 }
 
-// saveMeta writes metadata to disk
+// GetVersionPath returns the full path to the file of a given share version
+func (s *Storage) GetVersionPath(meta *ShareMeta, v *ShareVersion) string {
+	if v.Version == meta.CurrentVersion() {
+		return s.filePath(meta.ID, meta.FileName)
+	}
+	return filepath.Join(s.versionDir(meta.ID, v.Version), v.FileName)
+}
+
+// lockShare serializes changes to an existing share: within the process
+// through s.mu, and with other processes sharing DATA_DIR (the server and
+// the CLI) through a lock on the share's directory. Call the returned
+// function when done.
+func (s *Storage) lockShare(id string) (func(), error) {
+	s.mu.Lock()
+	unlock, err := lockDir(s.shareDir(id))
+	if err != nil {
+		s.mu.Unlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrShareNotFound
+		}
+		return nil, fmt.Errorf("locking share: %w", err)
+	}
+	return func() {
+		unlock()
+		s.mu.Unlock()
+	}, nil
+}
+
+// saveMeta writes metadata to disk. Callers updating an existing share hold
+// lockShare.
 func (s *Storage) saveMeta(meta *ShareMeta) error {
+	now := time.Now().UTC()
+	meta.ModifiedAt = &now
 	data, err := json.MarshalIndent(meta, "", "  ")
 	if err != nil {
 		return fmt.Errorf("encoding metadata: %w", err)
 	}
 
-	if err := os.WriteFile(s.metaPath(meta.ID), data, 0644); err != nil {
+	if err := writeFileAtomic(s.metaPath(meta.ID), data, 0644); err != nil {
 		return fmt.Errorf("writing metadata: %w", err)
 	}
 
 	return nil
 }
 
-// DeleteShare removes a share and its files
+// writeFileAtomic replaces a file through a temporary file and a rename, so
+// that other processes (such as the CLI and the server) never read a
+// partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// DeleteShare removes a share and its files, waiting for any change in
+// progress
 func (s *Storage) DeleteShare(id string) error {
+	if !ValidID(id) {
+		return ErrInvalidID
+	}
+	unlock, err := s.lockShare(id)
+	if errors.Is(err, ErrShareNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return os.RemoveAll(s.shareDir(id))
 }
 
-// CleanupExpired removes all expired shares
-func (s *Storage) CleanupExpired() (int, error) {
+// Cleanup triggers
+const (
+	CleanupStartup   = "startup"
+	CleanupScheduled = "scheduled"
+	CleanupManual    = "manual"
+)
+
+// maxCleanupHistory is the number of cleanup runs remembered
+const maxCleanupHistory = 50
+
+// CleanupRun records one pass of the expired share cleanup
+type CleanupRun struct {
+	StartedAt  time.Time `json:"startedAt"`
+	Trigger    string    `json:"trigger"`
+	Deleted    int       `json:"deleted"`
+	FreedBytes int64     `json:"freedBytes"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// CleanupExpired removes all expired shares and records the run in the
+// cleanup history
+func (s *Storage) CleanupExpired(trigger string) (CleanupRun, error) {
+	run := CleanupRun{StartedAt: time.Now().UTC(), Trigger: trigger}
+	var err error
+	run.Deleted, run.FreedBytes, err = s.cleanupExpired(trigger)
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	s.historyMu.Lock()
+	s.history = append(s.history, run)
+	if len(s.history) > maxCleanupHistory {
+		s.history = s.history[len(s.history)-maxCleanupHistory:]
+	}
+	s.historyMu.Unlock()
+
+	return run, err
+}
+
+// CleanupHistory returns the most recent cleanup runs, newest first
+func (s *Storage) CleanupHistory() []CleanupRun {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	runs := make([]CleanupRun, len(s.history))
+	for i, run := range s.history {
+		runs[len(runs)-1-i] = run
+	}
+	return runs
+}
+
+// ExpiredShares returns the shares whose expiry has passed
+func (s *Storage) ExpiredShares() ([]*ShareMeta, error) {
 	sharesDir := filepath.Join(s.dataDir, "shares")
 	entries, err := os.ReadDir(sharesDir)
 	if err != nil {
-		return 0, fmt.Errorf("reading shares directory: %w", err)
+		return nil, fmt.Errorf("reading shares directory: %w", err)
 	}
 
 	now := time.Now()
-	deleted := 0
-
+	var expired []*ShareMeta
 	for _, entry := range entries {
 		if !entry.IsDir() {
 			continue
@@ -190,14 +679,81 @@ func (s *Storage) CleanupExpired() (int, error) {
 		}
 
 		if meta.ExpiresAt != nil && meta.ExpiresAt.Before(now) {
-			if err := s.DeleteShare(meta.ID); err != nil {
-				continue // Log but continue with other shares
-			}
-			deleted++
+			expired = append(expired, meta)
 		}
 	}
+	return expired, nil
+}
 
-	return deleted, nil
+// cleanupExpired deletes expired shares, returning how many were deleted
+// and the disk space freed
+func (s *Storage) cleanupExpired(trigger string) (int, int64, error) {
+	expired, err := s.ExpiredShares()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	deleted := 0
+	var freed int64
+	for _, meta := range expired {
+		size, ok := s.deleteIfExpired(meta.ID)
+		if !ok {
+			continue
+		}
+		s.opts.Audit.Record(AuditEvent{
+			Event:    AuditExpire,
+			ShareID:  meta.ID,
+			Actor:    ActorSystem,
+			FileName: meta.FileName,
+			Bytes:    size,
+			Detail:   trigger,
+		})
+		deleted++
+		freed += size
+	}
+
+	return deleted, freed, nil
+}
+
+// deleteIfExpired deletes a share that is still expired once locked, since
+// another process may have extended it since it was listed. It returns the
+// space freed.
+func (s *Storage) deleteIfExpired(id string) (int64, bool) {
+	unlock, err := s.lockShare(id)
+	if err != nil {
+		return 0, false
+	}
+	defer unlock()
+
+	meta, err := s.GetShare(id)
+	if err != nil || meta == nil || meta.ExpiresAt == nil || !meta.ExpiresAt.Before(time.Now()) {
+		return 0, false
+	}
+	size := s.ShareDiskUsage(id)
+	if err := os.RemoveAll(s.shareDir(id)); err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// OwnerUsage returns the bytes taken by an account's shares, counting
+// every version kept
+func (s *Storage) OwnerUsage(ownerID string) (int64, error) {
+	shares, err := s.ListShares(0)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, meta := range shares {
+		if meta.OwnerID != ownerID {
+			continue
+		}
+		total += meta.FileSize
+		for _, v := range meta.Versions {
+			total += v.FileSize
+		}
+	}
+	return total, nil
 }
 
 // ListShares returns all shares sorted by created_at descending.
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAddVersionRetention(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxVersions int
+		uploads     int   // versions after the first
+		kept        []int // old versions left, oldest first
+	}{
+		{"unlimited", 0, 3, []int{1, 2, 3}},
+		{"under the limit", 5, 2, []int{1, 2}},
+		{"at the limit", 2, 2, []int{1, 2}},
+		{"over the limit", 2, 4, []int{3, 4}},
+		{"keep one", 1, 3, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(t.TempDir(), StorageOptions{MaxVersions: tt.maxVersions})
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, err := s.CreateShare(strings.NewReader("version 1"), "v1.txt", 9, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for v := 2; v <= tt.uploads+1; v++ {
+				content := fmt.Sprintf("version %d", v)
+				if meta, err = s.AddVersion(meta.ID, strings.NewReader(content), fmt.Sprintf("v%d.txt", v), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if meta.CurrentVersion() != tt.uploads+1 {
+				t.Errorf("current version %d, want %d", meta.CurrentVersion(), tt.uploads+1)
+			}
+			var kept []int
+			for _, v := range meta.Versions {
+				kept = append(kept, v.Version)
+			}
+			if !slices.Equal(kept, tt.kept) {
+				t.Errorf("kept versions %v, want %v", kept, tt.kept)
+			}
+
+			// Every listed version can still be read, and dropped ones are
+			// gone from disk
+			for v := 1; v <= tt.uploads+1; v++ {
+				version := meta.FindVersion(v)
+				if version == nil {
+					if _, err := os.Stat(s.versionDir(meta.ID, v)); !os.IsNotExist(err) {
+						t.Errorf("version %d dropped but still on disk", v)
+					}
+					continue
+				}
+				data, err := os.ReadFile(s.GetVersionPath(meta, version))
+				if err != nil {
+					t.Errorf("version %d: %v", v, err)
+				} else if want := fmt.Sprintf("version %d", v); string(data) != want {
+					t.Errorf("version %d reads %q, want %q", v, data, want)
+				}
+			}
+		})
+	}
+}
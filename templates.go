@@ -6,6 +6,8 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -19,6 +21,9 @@ var staticFS embed.FS
 type Templates struct {
 	upload   *template.Template
 	download *template.Template
+	admin    *template.Template
+	login    *template.Template
+	account  *template.Template
 }
 
 // LoadTemplates parses all templates
@@ -33,12 +38,53 @@ func LoadTemplates() (*Templates, error) {
 		return nil, fmt.Errorf("parsing download template: %w", err)
 	}
 
+	admin, err := template.ParseFS(templateFS, "templates/admin.html")
+	if err != nil {
+		return nil, fmt.Errorf("parsing admin template: %w", err)
+	}
+
+	login, err := template.ParseFS(templateFS, "templates/login.html")
+	if err != nil {
+		return nil, fmt.Errorf("parsing login template: %w", err)
+	}
+
+	account, err := template.ParseFS(templateFS, "templates/account.html")
+	if err != nil {
+		return nil, fmt.Errorf("parsing account template: %w", err)
+	}
+
 	return &Templates{
 		upload:   upload,
 		download: download,
+		admin:    admin,
+		login:    login,
+		account:  account,
 	}, nil
 }
 
+// UploadPageData is the data passed to the upload template
+type UploadPageData struct {
+	// Request is set when uploading through a file request link
+	Request *RequestPageData
+	// StripMetadata offers the per-upload opt-out when stripping is enabled
+	StripMetadata bool
+	// Accounts shows who is signed in, or a link to sign in
+	Accounts bool
+	UserName string
+	// LoginRequired hides the upload form from anonymous visitors
+	LoginRequired bool
+}
+
+// RequestPageData describes a file request on the upload page
+type RequestPageData struct {
+	ID                string
+	Label             string
+	Closed            bool
+	MaxFiles          int
+	MaxTotalSize      string
+	AllowedExtensions string
+}
+
 // DownloadPageData is the data passed to the download template
 type DownloadPageData struct {
 	ID                string
@@ -46,6 +92,54 @@ type DownloadPageData struct {
 	FileSize          int64
 	FileSizeFormatted string
 	ExpiresAt         string
+	DownloadURL       string
+	Version           int
+	IsLatest          bool
+	Versions          []VersionPageData
+	PreviewKind       string
+	PreviewURL        string
+	PreviewText       string
+	PreviewTruncated  bool
+	MetadataStripped  bool
+	ShareURL          string
+	ThumbnailURL      string
+	QRCodeURL         string
+	Archive           *ArchivePageData
+	Unfurl            *Unfurl
+}
+
+// ArchivePageData lists the files inside an archive share
+type ArchivePageData struct {
+	Format             string
+	FileCount          int
+	TotalSizeFormatted string
+	Entries            []ArchiveEntryPageData
+}
+
+// ArchiveEntryPageData is one file in the archive listing
+type ArchiveEntryPageData struct {
+	Path          string
+	SizeFormatted string
+	URL           string
+}
+
+// VersionPageData describes one entry in the download page's version history
+type VersionPageData struct {
+	Version           int
+	FileName          string
+	FileSizeFormatted string
+	CreatedAt         string
+	URL               string
+	Selected          bool
+}
+
+// reverseVersions returns a copy of versions in reverse order
+func reverseVersions(versions []ShareVersion) []ShareVersion {
+	out := make([]ShareVersion, len(versions))
+	for i, v := range versions {
+		out[len(versions)-1-i] = v
+	}
+	return out
 }
 
 func formatFileSize(bytes int64) string {
@@ -63,7 +157,50 @@ func formatFileSize(bytes int64) string {
 
 // HandleUploadPage serves the upload page
 func (h *Handlers) HandleUploadPage(w http.ResponseWriter, r *http.Request, tmpl *Templates) {
-	if err := tmpl.upload.Execute(w, nil); err != nil {
+	data := UploadPageData{StripMetadata: h.storage.StripsMetadata(), Accounts: h.users != nil}
+	if user := h.currentUser(r); user != nil {
+		data.UserName = user.Name
+	} else {
+		data.LoginRequired = h.loginToUpload
+	}
+	if err := tmpl.upload.Execute(w, data); err != nil {
+		log.Printf("Error rendering upload page: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
+
+// HandleRequestPage serves the upload page for a file request
+func (h *Handlers) HandleRequestPage(w http.ResponseWriter, r *http.Request, tmpl *Templates) {
+	// Extract ID from path like /r/abc123
+	id := strings.TrimPrefix(r.URL.Path, "/r/")
+	if !ValidID(id) {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+
+	req, err := h.requests.GetRequest(id)
+	if err != nil {
+		log.Printf("Error getting request: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if req == nil {
+		http.Error(w, "File request not found", http.StatusNotFound)
+		return
+	}
+
+	data := RequestPageData{
+		ID:                req.ID,
+		Label:             req.Label,
+		Closed:            !req.IsOpen(),
+		MaxFiles:          req.MaxFiles,
+		AllowedExtensions: strings.Join(req.AllowedExtensions, ", "),
+	}
+	if req.MaxTotalSize > 0 {
+		data.MaxTotalSize = formatFileSize(req.MaxTotalSize)
+	}
+
+	if err := tmpl.upload.Execute(w, UploadPageData{Request: &data}); err != nil {
 		log.Printf("Error rendering upload page: %v", err)
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 	}
@@ -71,9 +208,14 @@ func (h *Handlers) HandleUploadPage(w http.ResponseWriter, r *http.Request, tmpl
 
 // HandleDownloadPage serves the download page
 func (h *Handlers) HandleDownloadPage(w http.ResponseWriter, r *http.Request, tmpl *Templates) {
+	if !h.downloadAllowed(r) {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
 	// Extract ID from path like /s/abc123
 	id := strings.TrimPrefix(r.URL.Path, "/s/")
-	if id == "" || strings.Contains(id, "/") {
+	if !ValidID(id) {
 		http.Error(w, "Invalid share ID", http.StatusBadRequest)
 		return
 	}
@@ -89,11 +231,79 @@ func (h *Handlers) HandleDownloadPage(w http.ResponseWriter, r *http.Request, tm
 		return
 	}
 
+	version := requestedVersion(w, r, meta)
+	if version == nil {
+		return
+	}
+
 	data := DownloadPageData{
 		ID:                meta.ID,
-		FileName:          meta.FileName,
-		FileSize:          meta.FileSize,
-		FileSizeFormatted: formatFileSize(meta.FileSize),
+		FileName:          version.FileName,
+		FileSize:          version.FileSize,
+		FileSizeFormatted: formatFileSize(version.FileSize),
+		DownloadURL:       "/d/" + meta.ID + "/" + url.PathEscape(version.FileName),
+		Version:           version.Version,
+		IsLatest:          version.Version == meta.CurrentVersion(),
+		MetadataStripped:  version.Stripped,
+	}
+	data.ShareURL = h.shareURL(meta.ID)
+	data.Unfurl = h.shareUnfurl(meta, version)
+	data.QRCodeURL = "/s/" + meta.ID + "/qr.svg"
+	if meta.HasThumbnail && data.IsLatest {
+		data.ThumbnailURL = h.thumbnailURL(meta.ID)
+	}
+
+	data.PreviewURL = "/api/share/" + meta.ID + "/preview"
+	if !data.IsLatest {
+		data.DownloadURL += "?v=" + strconv.Itoa(version.Version)
+		data.PreviewURL += "?v=" + strconv.Itoa(version.Version)
+	}
+
+	_, data.PreviewKind = h.versionPreview(meta, version)
+	if data.PreviewKind == PreviewText {
+		data.PreviewText, data.PreviewTruncated = readTextPreview(h.storage.GetVersionPath(meta, version))
+	}
+
+	idx, err := h.storage.GetArchiveIndex(meta, version)
+	if err != nil {
+		log.Printf("Error getting archive index: %v", err)
+	}
+	if idx != nil {
+		data.Archive = &ArchivePageData{
+			Format:             idx.Format,
+			FileCount:          len(idx.Entries),
+			TotalSizeFormatted: formatFileSize(idx.TotalSize),
+		}
+		for _, e := range idx.Entries {
+			entryURL := "/api/share/" + meta.ID + "/entry?path=" + url.QueryEscape(e.Path)
+			if !data.IsLatest {
+				entryURL += "&v=" + strconv.Itoa(version.Version)
+			}
+			data.Archive.Entries = append(data.Archive.Entries, ArchiveEntryPageData{
+				Path:          e.Path,
+				SizeFormatted: formatFileSize(e.Size),
+				URL:           entryURL,
+			})
+		}
+	}
+
+	// Version history, newest first
+	if len(meta.Versions) > 0 {
+		all := append([]ShareVersion{meta.LatestVersion()}, reverseVersions(meta.Versions)...)
+		for i, v := range all {
+			url := "/s/" + meta.ID
+			if i > 0 {
+				url += "?v=" + strconv.Itoa(v.Version)
+			}
+			data.Versions = append(data.Versions, VersionPageData{
+				Version:           v.Version,
+				FileName:          v.FileName,
+				FileSizeFormatted: formatFileSize(v.FileSize),
+				CreatedAt:         v.CreatedAt.Format("Jan 2, 2006 15:04"),
+				URL:               url,
+				Selected:          v.Version == version.Version,
+			})
+		}
 	}
 
 	if meta.ExpiresAt != nil {
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the largest write or read passed through a limiter at
+// once, which keeps transfers smooth instead of bursty
+const throttleChunk = 32 * 1024
+
+// RateLimiter is a token bucket measured in bytes per second. It is safe for
+// concurrent use; goroutines sharing one split its rate between them.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens (bytes) added per second
+	burst  float64 // bucket capacity
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing bytesPerSec, or returns nil if
+// the rate is unlimited
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := float64(max(bytesPerSec, throttleChunk))
+	return &RateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// WaitN blocks until n bytes may be transferred. Tokens are reserved before
+// waiting, so concurrent callers are served in the order they arrive.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Hand back the reservation we won't use
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Throttle caps transfer speed per connection and across all connections
+// in one direction
+type Throttle struct {
+	perConn int64
+	global  *RateLimiter
+}
+
+// NewThrottle creates a throttle from byte-per-second limits, where 0 means
+// unlimited
+func NewThrottle(perConn, global int64) *Throttle {
+	return &Throttle{
+		perConn: perConn,
+		global:  NewRateLimiter(global),
+	}
+}
+
+// limiters returns the buckets a new connection must draw from
+func (t *Throttle) limiters() []*RateLimiter {
+	var ls []*RateLimiter
+	if t == nil {
+		return ls
+	}
+	if l := NewRateLimiter(t.perConn); l != nil {
+		ls = append(ls, l)
+	}
+	if t.global != nil {
+		ls = append(ls, t.global)
+	}
+	return ls
+}
+
+// waitAll blocks until n bytes are available from every limiter
+func waitAll(ctx context.Context, ls []*RateLimiter, n int) error {
+	for _, l := range ls {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writer wraps a response so its body is written at the throttled rate.
+// Only Write is intercepted, so http.ServeContent still handles seeking and
+// ranges on the underlying file.
+func (t *Throttle) Writer(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	ls := t.limiters()
+	if len(ls) == 0 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiters: ls}
+}
+
+// Body wraps a request body so it is read at the throttled rate
+func (t *Throttle) Body(r *http.Request) io.ReadCloser {
+	ls := t.limiters()
+	if len(ls) == 0 {
+		return r.Body
+	}
+	return &throttledReader{ReadCloser: r.Body, ctx: r.Context(), limiters: ls}
+}
+
+// throttledWriter is an http.ResponseWriter limited by token buckets
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*RateLimiter
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), throttleChunk)
+		if err := waitAll(tw.ctx, tw.limiters, n); err != nil {
+			return written, err
+		}
+		m, err := tw.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttledReader is a request body limited by token buckets
+type throttledReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*RateLimiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := waitAll(tr.ctx, tr.limiters, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
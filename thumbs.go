@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // register decoders for image.Decode
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	thumbName      = "thumb.jpg"
+	thumbMaxSize   = 320        // longest edge in pixels
+	thumbMaxPixels = 40_000_000 // refuse to decode anything larger
+	thumbQueueSize = 64         // thumbnails waiting to be generated
+)
+
+// thumbJob asks for a thumbnail of one version of a share
+type thumbJob struct {
+	s       *Storage
+	id      string
+	version int
+	srcPath string
+}
+
+// Thumbnails are generated off the request path by a single worker, so
+// memory use stays bounded by one image of at most thumbMaxPixels
+var (
+	thumbQueue      = make(chan thumbJob, thumbQueueSize)
+	thumbWorkerOnce sync.Once
+)
+
+// thumbnailable lists the detected types we can decode with the standard
+// library. WebP would need golang.org/x/image, which we don't depend on.
+var thumbnailable = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// thumbPath returns the path to a share's thumbnail
+func (s *Storage) thumbPath(id string) string {
+	return filepath.Join(s.shareDir(id), thumbName)
+}
+
+// GetThumbPath returns the full path to a share's thumbnail
+func (s *Storage) GetThumbPath(id string) string {
+	return s.thumbPath(id)
+}
+
+// queueThumbnail schedules a thumbnail for an image share's current
+// version, which is saved into its metadata once generated. When the
+// queue is full the share goes without one.
+func (s *Storage) queueThumbnail(meta *ShareMeta) {
+	if !thumbnailable[strings.SplitN(meta.DetectedType, ";", 2)[0]] {
+		return
+	}
+	thumbWorkerOnce.Do(func() { go thumbWorker() })
+
+	job := thumbJob{s: s, id: meta.ID, version: meta.CurrentVersion(), srcPath: s.filePath(meta.ID, meta.FileName)}
+	select {
+	case thumbQueue <- job:
+	default:
+		log.Printf("Skipping thumbnail for %s: generator busy", meta.ID)
+	}
+}
+
+// thumbWorker generates queued thumbnails one at a time
+func thumbWorker() {
+	for job := range thumbQueue {
+		if err := job.s.generateThumbnail(job); err != nil {
+			log.Printf("Error generating thumbnail for %s: %v", job.id, err)
+		}
+	}
+}
+
+// generateThumbnail writes a JPEG thumbnail for a version of a share and
+// marks the share as having one, unless a newer version replaced it first
+func (s *Storage) generateThumbnail(job thumbJob) error {
+	tmp, err := writeThumbnail(job.srcPath, s.shareDir(job.id))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	unlock, err := s.lockShare(job.id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	meta, err := s.GetShare(job.id)
+	if err != nil {
+		return err
+	}
+	if meta == nil || meta.CurrentVersion() != job.version {
+		return nil
+	}
+	if err := os.Rename(tmp, s.thumbPath(job.id)); err != nil {
+		return err
+	}
+	meta.HasThumbnail = true
+	return s.saveMeta(meta)
+}
+
+// writeThumbnail decodes an image and writes a downscaled JPEG copy to a
+// temporary file in dir, returning its path
+func writeThumbnail(srcPath, dir string) (string, error) {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Check dimensions before decoding so decompression bombs are rejected
+	// without allocating the full bitmap
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", fmt.Errorf("reading image header: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > thumbMaxPixels {
+		return "", fmt.Errorf("image is %dx%d, too large to thumbnail", cfg.Width, cfg.Height)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("decoding image: %w", err)
+	}
+
+	thumb := downscale(src, thumbMaxSize)
+
+	out, err := os.CreateTemp(dir, ".thumb-*")
+	if err != nil {
+		return "", err
+	}
+	if err := jpeg.Encode(out, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", fmt.Errorf("encoding thumbnail: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// downscale shrinks an image so its longest edge is at most maxSize,
+// averaging a small grid of samples per output pixel. Transparent areas are
+// composited onto white since JPEG has no alpha.
+func downscale(src image.Image, maxSize int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > maxSize || h > maxSize {
+		if w >= h {
+			dw, dh = maxSize, max(1, h*maxSize/w)
+		} else {
+			dw, dh = max(1, w*maxSize/h), maxSize
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	const samples = 4
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var r, g, bl, a uint32
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px := b.Min.X + (x*samples+sx)*w/(dw*samples)
+					py := b.Min.Y + (y*samples+sy)*h/(dh*samples)
+					cr, cg, cb, ca := src.At(px, py).RGBA()
+					r += cr
+					g += cg
+					bl += cb
+					a += ca
+				}
+			}
+			// Colors are premultiplied, so adding the uncovered part
+			// composites over white
+			n := uint32(samples * samples)
+			white := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r/n + white) >> 8),
+				G: uint8((g/n + white) >> 8),
+				B: uint8((bl/n + white) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+// HandleThumbnail handles GET and HEAD /api/share/:id/thumb
+func (h *Handlers) HandleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if !isReadMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.checkDownloader(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/share/")
+	id := strings.TrimSuffix(path, "/thumb")
+	if !ValidID(id) {
+		http.Error(w, "Invalid share ID", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := h.storage.GetShare(id)
+	if err != nil {
+		log.Printf("Error getting share: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if meta == nil || !meta.HasThumbnail {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(h.storage.GetThumbPath(id))
+	if err != nil {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// The thumbnail changes with each new version, so derive its validator
+	// from the latest version's hash
+	latest := meta.LatestVersion()
+	if latest.SHA256 != "" {
+		w.Header().Set("ETag", `"thumb-`+latest.SHA256+`"`)
+	}
+	w.Header().Set("Cache-Control", h.cacheControl(meta, false))
+	http.ServeContent(w, r, "", latest.CreatedAt, f)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Link preview modes, set with UNFURL
+const (
+	UnfurlFull    = "full"    // file name, size, expiry and thumbnail
+	UnfurlMinimal = "minimal" // a generic title that reveals nothing about the file
+	UnfurlOff     = "off"     // no preview metadata and no oEmbed
+)
+
+// unfurlTitle is shown in place of the file name when previews are minimal
+const unfurlTitle = "Shared file"
+
+// Unfurl is the OpenGraph, Twitter card and oEmbed metadata of a share page
+type Unfurl struct {
+	Title       string
+	Description string
+	URL         string
+	ImageURL    string
+	ImageWidth  int
+	ImageHeight int
+	OEmbedURL   string
+}
+
+// TwitterCard returns the Twitter card type for the preview
+func (u *Unfurl) TwitterCard() string {
+	if u.ImageURL != "" {
+		return "summary_large_image"
+	}
+	return "summary"
+}
+
+// unfurlMode returns how much a share's link previews may reveal. Private
+// shares never show up in previews.
+func (h *Handlers) unfurlMode(meta *ShareMeta) string {
+	if meta.Private {
+		return UnfurlOff
+	}
+	return h.unfurl
+}
+
+// versionPageURL returns the share page URL for a version
+func (h *Handlers) versionPageURL(meta *ShareMeta, version *ShareVersion) string {
+	if version.Version == meta.CurrentVersion() {
+		return h.shareURL(meta.ID)
+	}
+	return h.shareURL(meta.ID) + "?v=" + strconv.Itoa(version.Version)
+}
+
+// shareUnfurl builds the link preview of a share version, or nil when the
+// share must not be previewed
+func (h *Handlers) shareUnfurl(meta *ShareMeta, version *ShareVersion) *Unfurl {
+	mode := h.unfurlMode(meta)
+	if mode == UnfurlOff {
+		return nil
+	}
+
+	pageURL := h.versionPageURL(meta, version)
+	u := &Unfurl{
+		Title:     unfurlTitle,
+		URL:       pageURL,
+		OEmbedURL: h.baseURL + "/oembed?format=json&url=" + url.QueryEscape(pageURL),
+	}
+	if mode == UnfurlMinimal {
+		return u
+	}
+
+	u.Title = version.FileName
+	u.Description = formatFileSize(version.FileSize)
+	if meta.ExpiresAt != nil {
+		u.Description += " · Expires " + meta.ExpiresAt.Format("Jan 2, 2006")
+	}
+	if meta.HasThumbnail && version.Version == meta.CurrentVersion() {
+		if w, ht, ok := h.thumbnailSize(meta.ID); ok {
+			u.ImageURL = h.thumbnailURL(meta.ID)
+			u.ImageWidth, u.ImageHeight = w, ht
+		}
+	}
+	return u
+}
+
+// thumbnailSize returns the pixel dimensions of a share's thumbnail
+func (h *Handlers) thumbnailSize(id string) (width, height int, ok bool) {
+	f, err := os.Open(h.storage.GetThumbPath(id))
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// OEmbedResponse is the oEmbed "link" response for a share
+type OEmbedResponse struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	Title           string `json:"title"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	CacheAge        int64  `json:"cache_age,omitempty"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+// HandleOEmbed handles GET /oembed?url=...&format=json for share page URLs.
+// Shares that must not be previewed are reported as not found.
+func (h *Handlers) HandleOEmbed(w http.ResponseWriter, r *http.Request) {
+	if !isReadMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.checkDownloader(w, r) {
+		return
+	}
+	if h.unfurl == UnfurlOff {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	if format := q.Get("format"); format != "" && format != "json" {
+		http.Error(w, "Only JSON is supported", http.StatusNotImplemented)
+		return
+	}
+
+	meta, version := h.oembedTarget(q.Get("url"))
+	if meta == nil || version == nil {
+		http.NotFound(w, r)
+		return
+	}
+	u := h.shareUnfurl(meta, version)
+	if u == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	response := OEmbedResponse{
+		Type:            "link",
+		Version:         "1.0",
+		Title:           u.Title,
+		ProviderName:    "kiss-drop",
+		ProviderURL:     h.baseURL + "/",
+		ThumbnailURL:    u.ImageURL,
+		ThumbnailWidth:  u.ImageWidth,
+		ThumbnailHeight: u.ImageHeight,
+	}
+	if meta.ExpiresAt != nil {
+		response.CacheAge = max(int64(time.Until(*meta.ExpiresAt).Seconds()), 0)
+	}
+	serveJSON(w, r, response, meta.LastModified())
+}
+
+// oembedTarget resolves a share page URL on this server to its share and
+// version, returning nils for anything else
+func (h *Handlers) oembedTarget(rawURL string) (*ShareMeta, *ShareVersion) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil
+	}
+	base, err := url.Parse(h.baseURL)
+	if err != nil || !strings.EqualFold(target.Host, base.Host) {
+		return nil, nil
+	}
+
+	id, ok := strings.CutPrefix(target.Path, base.Path+"/s/")
+	if !ok || !ValidID(id) {
+		return nil, nil
+	}
+	meta, err := h.storage.GetShare(id)
+	if err != nil || meta == nil {
+		return nil, nil
+	}
+
+	if vStr := target.Query().Get("v"); vStr != "" {
+		n, err := strconv.Atoi(vStr)
+		if err != nil {
+			return nil, nil
+		}
+		return meta, meta.FindVersion(n)
+	}
+	latest := meta.LatestVersion()
+	return meta, &latest
+}
+
+// parseUnfurlMode validates an UNFURL setting
+func parseUnfurlMode(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case UnfurlFull, UnfurlMinimal, UnfurlOff:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown UNFURL mode %q (want %s, %s or %s)", mode, UnfurlFull, UnfurlMinimal, UnfurlOff)
+}
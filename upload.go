@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
@@ -17,25 +18,35 @@ const (
 
 // UploadSession tracks an in-progress chunked upload
 type UploadSession struct {
-	ID           string     `json:"id"`
-	FileName     string     `json:"file_name"`
-	FileSize     int64      `json:"file_size"`
-	ChunkSize    int64      `json:"chunk_size"`
-	TotalChunks  int        `json:"total_chunks"`
-	ExpiresIn    string     `json:"expires_in,omitempty"`
-	ReceivedMask []bool     `json:"received_mask"`
-	CreatedAt    time.Time  `json:"created_at"`
-	LastActivity time.Time  `json:"last_activity"`
-	UploaderIP   string     `json:"uploader_ip,omitempty"`
-	UserAgent    string     `json:"user_agent,omitempty"`
-	ContentType  string     `json:"content_type,omitempty"`
-	mu           sync.Mutex `json:"-"`
+	ID              string     `json:"id"`
+	FileName        string     `json:"file_name"`
+	FileSize        int64      `json:"file_size"`
+	ChunkSize       int64      `json:"chunk_size"`
+	TotalChunks     int        `json:"total_chunks"`
+	ExpiresIn       string     `json:"expires_in,omitempty"`
+	ReceivedMask    []bool     `json:"received_mask"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastActivity    time.Time  `json:"last_activity"`
+	UploaderIP      string     `json:"uploader_ip,omitempty"`
+	UserAgent       string     `json:"user_agent,omitempty"`
+	ContentType     string     `json:"content_type,omitempty"`
+	RequestID       string     `json:"request_id,omitempty"`
+	ShareID         string     `json:"share_id,omitempty"`
+	KeepMetadata    bool       `json:"keep_metadata,omitempty"`
+	Slug            string     `json:"slug,omitempty"`
+	Private         bool       `json:"private,omitempty"`
+	OwnerID         string     `json:"owner_id,omitempty"`
+	Actor           string     `json:"actor,omitempty"`
+	Finalizing      bool       `json:"finalizing,omitempty"`
+	ManageTokenHash string     `json:"-"`
+	mu              sync.Mutex `json:"-"`
 }
 
 // UploadManager handles chunked uploads
 type UploadManager struct {
 	dataDir  string
 	sessions map[string]*UploadSession
+	jobs     map[string]*FinalizeJob // keyed by upload ID
 	mu       sync.RWMutex
 }
 
@@ -49,6 +60,7 @@ func NewUploadManager(dataDir string) (*UploadManager, error) {
 	um := &UploadManager{
 		dataDir:  dataDir,
 		sessions: make(map[string]*UploadSession),
+		jobs:     make(map[string]*FinalizeJob),
 	}
 
 	// Start cleanup goroutine for stale uploads
@@ -72,6 +84,15 @@ func (um *UploadManager) chunkPath(uploadID string, index int) string {
 	return filepath.Join(um.sessionDir(uploadID), fmt.Sprintf("chunk_%05d", index))
 }
 
+// chunkSize returns the size of a chunk on disk
+func (um *UploadManager) chunkSize(uploadID string, index int) (int64, error) {
+	fi, err := os.Stat(um.chunkPath(uploadID, index))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
 // InitUpload creates a new upload session
 func (um *UploadManager) InitUpload(fileName string, fileSize int64, expiresIn string, info *UploadInfo) (*UploadSession, error) {
 	id, err := GenerateID()
@@ -106,6 +127,14 @@ func (um *UploadManager) InitUpload(fileName string, fileSize int64, expiresIn s
 		session.UploaderIP = info.UploaderIP
 		session.UserAgent = info.UserAgent
 		session.ContentType = info.ContentType
+		session.RequestID = info.RequestID
+		session.ShareID = info.ShareID
+		session.KeepMetadata = info.KeepMetadata
+		session.Slug = info.Slug
+		session.Private = info.Private
+		session.OwnerID = info.OwnerID
+		session.Actor = info.Actor
+		session.ManageTokenHash = info.ManageTokenHash
 	}
 
 	um.mu.Lock()
@@ -117,11 +146,54 @@ func (um *UploadManager) InitUpload(fileName string, fileSize int64, expiresIn s
 
 // GetSession retrieves an upload session
 func (um *UploadManager) GetSession(uploadID string) *UploadSession {
+	if !ValidID(uploadID) {
+		return nil
+	}
 	um.mu.RLock()
 	defer um.mu.RUnlock()
 	return um.sessions[uploadID]
 }
 
+// ListSessions returns all upload sessions, most recently active first
+func (um *UploadManager) ListSessions() []UploadSessionJSON {
+	// ToJSON waits for the session's lock, which a throttled chunk write can
+	// hold for a while, so don't hold um.mu meanwhile
+	um.mu.RLock()
+	list := make([]*UploadSession, 0, len(um.sessions))
+	for _, session := range um.sessions {
+		list = append(list, session)
+	}
+	um.mu.RUnlock()
+
+	sessions := make([]UploadSessionJSON, 0, len(list))
+	for _, session := range list {
+		sessions = append(sessions, session.ToJSON())
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastActivity.After(sessions[j].LastActivity)
+	})
+	return sessions
+}
+
+// PendingBytes returns the size of the files an account is still uploading
+func (um *UploadManager) PendingBytes(ownerID string) int64 {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	var total int64
+	for _, session := range um.sessions {
+		if session.OwnerID == ownerID {
+			total += session.FileSize
+		}
+	}
+	return total
+}
+
+// DiskUsage returns the bytes used by chunks of unfinished uploads
+func (um *UploadManager) DiskUsage() int64 {
+	return dirSize(um.uploadsDir())
+}
+
 // ReceiveChunk saves a chunk and updates the session
 func (um *UploadManager) ReceiveChunk(uploadID string, index int, data io.Reader) error {
 	session := um.GetSession(uploadID)
@@ -132,6 +204,9 @@ func (um *UploadManager) ReceiveChunk(uploadID string, index int, data io.Reader
 	session.mu.Lock()
 	defer session.mu.Unlock()
 
+	if session.Finalizing {
+		return ErrUploadFinalizing
+	}
 	if index < 0 || index >= session.TotalChunks {
 		return fmt.Errorf("invalid chunk index")
 	}
@@ -192,49 +267,11 @@ func (um *UploadManager) ReceivedCount(uploadID string) int {
 	return count
 }
 
-// AssembleFile combines all chunks into the final file
-func (um *UploadManager) AssembleFile(uploadID string, storage *Storage) (*ShareMeta, error) {
-	session := um.GetSession(uploadID)
-	if session == nil {
-		return nil, fmt.Errorf("session not found")
-	}
-
-	if !um.IsComplete(uploadID) {
-		return nil, fmt.Errorf("upload not complete")
-	}
-
-	// Create a reader that reads all chunks in order
-	reader := &chunkReader{
-		um:       um,
-		uploadID: uploadID,
-		session:  session,
-	}
-
-	// Calculate expiration
-	var expiresAt *time.Time
-	if session.ExpiresIn != "" && session.ExpiresIn != "never" {
-		// This is handled by the handler, but we need to pass it through
-	}
-
-	// Create the share with upload info
-	info := &UploadInfo{
-		UploaderIP:  session.UploaderIP,
-		UserAgent:   session.UserAgent,
-		ContentType: session.ContentType,
-	}
-	meta, err := storage.CreateShare(reader, session.FileName, session.FileSize, expiresAt, info)
-	if err != nil {
-		return nil, fmt.Errorf("creating share: %w", err)
-	}
-
-	// Cleanup the upload session
-	um.Cleanup(uploadID)
-
-	return meta, nil
-}
-
 // Cleanup removes an upload session and its files
 func (um *UploadManager) Cleanup(uploadID string) {
+	if !ValidID(uploadID) {
+		return
+	}
 	um.mu.Lock()
 	delete(um.sessions, uploadID)
 	um.mu.Unlock()
@@ -258,11 +295,65 @@ func (um *UploadManager) cleanupStale() {
 
 	now := time.Now()
 	for id, session := range um.sessions {
-		if now.Sub(session.LastActivity) > uploadTimeout {
+		if now.Sub(session.LastActivity) > uploadTimeout && !session.Finalizing {
 			delete(um.sessions, id)
 			os.RemoveAll(um.sessionDir(id))
 		}
 	}
+
+	// Keep finished job results around long enough for clients to retry
+	for id, job := range um.jobs {
+		if job.finishedBefore(now.Add(-uploadTimeout)) {
+			delete(um.jobs, id)
+		}
+	}
+}
+
+// StaleUpload describes the chunks left on disk by an upload
+type StaleUpload struct {
+	ID           string    `json:"id"`
+	Chunks       int       `json:"chunks"`
+	Size         int64     `json:"size"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+// StaleUploads lists upload directories that no live session of this
+// manager owns and that haven't been written to for the given time. Sessions
+// only live in memory, so directories left behind by a restart are never
+// cleaned up otherwise.
+func (um *UploadManager) StaleUploads(idle time.Duration) ([]StaleUpload, error) {
+	entries, err := os.ReadDir(um.uploadsDir())
+	if err != nil {
+		return nil, fmt.Errorf("reading uploads directory: %w", err)
+	}
+
+	cutoff := time.Now().Add(-idle)
+	var stale []StaleUpload
+	for _, entry := range entries {
+		if !entry.IsDir() || !ValidID(entry.Name()) || um.GetSession(entry.Name()) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		upload := StaleUpload{ID: entry.Name(), LastActivity: info.ModTime()}
+
+		chunks, _ := os.ReadDir(um.sessionDir(upload.ID))
+		for _, chunk := range chunks {
+			if info, err := chunk.Info(); err == nil {
+				upload.Chunks++
+				upload.Size += info.Size()
+				if info.ModTime().After(upload.LastActivity) {
+					upload.LastActivity = info.ModTime()
+				}
+			}
+		}
+		if upload.LastActivity.Before(cutoff) {
+			stale = append(stale, upload)
+		}
+	}
+	return stale, nil
 }
 
 // chunkReader reads chunks sequentially
@@ -303,18 +394,6 @@ func (r *chunkReader) Read(p []byte) (int, error) {
 	}
 }
 
-// InitUploadResponse is returned when starting a new upload
-type InitUploadResponse struct {
-	UploadID    string `json:"uploadId"`
-	ChunkSize   int64  `json:"chunkSize"`
-	TotalChunks int    `json:"totalChunks"`
-}
-
-// ChunkResponse is returned after receiving a chunk
-type ChunkResponse struct {
-	Received int `json:"received"`
-}
-
 // UploadSessionJSON is used for JSON serialization
 type UploadSessionJSON struct {
 	ID           string    `json:"id"`
@@ -323,7 +402,11 @@ type UploadSessionJSON struct {
 	ChunkSize    int64     `json:"chunkSize"`
 	TotalChunks  int       `json:"totalChunks"`
 	Received     int       `json:"received"`
+	CreatedAt    time.Time `json:"createdAt"`
 	LastActivity time.Time `json:"lastActivity"`
+	UploaderIP   string    `json:"uploaderIP,omitempty"`
+	UserAgent    string    `json:"userAgent,omitempty"`
+	Finalizing   bool      `json:"finalizing,omitempty"`
 }
 
 func (s *UploadSession) ToJSON() UploadSessionJSON {
@@ -344,7 +427,11 @@ func (s *UploadSession) ToJSON() UploadSessionJSON {
 		ChunkSize:    s.ChunkSize,
 		TotalChunks:  s.TotalChunks,
 		Received:     received,
+		CreatedAt:    s.CreatedAt,
 		LastActivity: s.LastActivity,
+		UploaderIP:   s.UploaderIP,
+		UserAgent:    s.UserAgent,
+		Finalizing:   s.Finalizing,
 	}
 }
 
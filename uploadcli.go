@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zackgomez/kiss-drop/client"
+)
+
+const (
+	defaultServer      = "http://localhost:8080"
+	defaultParallelism = 4
+)
+
+// savedUpload is what's needed to resume the upload of one file
+type savedUpload struct {
+	Server  string              `json:"server"`
+	ModTime time.Time           `json:"modTime"`
+	Upload  *client.UploadState `json:"upload"`
+}
+
+// uploadStateFile persists resume state across runs, keyed by absolute path
+type uploadStateFile struct {
+	path    string
+	mu      sync.Mutex
+	Uploads map[string]*savedUpload `json:"uploads"`
+}
+
+// defaultStatePath returns the resume state location in the user cache dir
+func defaultStatePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kiss-drop", "uploads.json")
+}
+
+// loadUploadState reads the state file; a missing or unreadable one starts empty
+func loadUploadState(path string) *uploadStateFile {
+	sf := &uploadStateFile{path: path, Uploads: make(map[string]*savedUpload)}
+	if path == "" {
+		return sf
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, sf)
+		if sf.Uploads == nil {
+			sf.Uploads = make(map[string]*savedUpload)
+		}
+	}
+	return sf
+}
+
+// update changes the state under the lock and writes it out
+func (sf *uploadStateFile) update(fn func(map[string]*savedUpload)) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	fn(sf.Uploads)
+	if sf.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(sf.path), 0700); err != nil {
+		return err
+	}
+	// Holds management tokens, so keep it private
+	return writeFileAtomic(sf.path, data, 0600)
+}
+
+// resume returns the saved upload of a file if it still matches the file
+// and server
+func (sf *uploadStateFile) resume(key, server string, info os.FileInfo) *client.UploadState {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	saved := sf.Uploads[key]
+
+	// The server drops sessions after uploadTimeout of inactivity
+	if saved == nil || saved.Upload == nil || saved.Server != server ||
+		saved.Upload.Size != info.Size() || !saved.ModTime.Equal(info.ModTime()) ||
+		time.Since(saved.Upload.StartedAt) > uploadTimeout {
+		return nil
+	}
+	return saved.Upload
+}
+
+// uploadResult is printed for each uploaded file
+type uploadResult struct {
+	File        string `json:"file"`
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	ManageToken string `json:"manageToken,omitempty"`
+}
+
+// uploader sends files for the upload command
+type uploader struct {
+	client   *client.Client
+	server   string
+	expires  string
+	parallel int
+	state    *uploadStateFile
+	progress bool
+}
+
+// upload sends one file, resuming an earlier attempt when the state file
+// has one for the same server and unchanged file
+func (up *uploader) upload(ctx context.Context, path, name string, resumable bool) (*uploadResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+
+	opts := client.UploadOptions{
+		FileName:  name,
+		ExpiresIn: up.expires,
+		Parallel:  up.parallel,
+	}
+	key := ""
+	if resumable {
+		if key, err = filepath.Abs(path); err != nil {
+			return nil, err
+		}
+		opts.State = up.state.resume(key, up.server, info)
+		opts.SaveState = func(st *client.UploadState) {
+			up.state.update(func(m map[string]*savedUpload) {
+				m[key] = &savedUpload{Server: up.server, ModTime: info.ModTime(), Upload: st}
+			})
+		}
+	}
+
+	var sent atomic.Int64
+	opts.Progress = func(n, total int64) { sent.Store(n) }
+	stopProgress := up.showProgress(name, info.Size(), resumedBytes(opts.State), &sent)
+	result, err := up.client.Upload(ctx, f, opts)
+	stopProgress()
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		up.state.update(func(m map[string]*savedUpload) { delete(m, key) })
+	}
+	return &uploadResult{ID: result.ID, URL: result.URL, ManageToken: result.ManageToken}, nil
+}
+
+// resumedBytes returns the number of bytes an earlier run already sent
+func resumedBytes(st *client.UploadState) int64 {
+	if st == nil {
+		return 0
+	}
+	var n int64
+	for i, done := range st.Done {
+		if done {
+			n += min(st.ChunkSize, st.Size-int64(i)*st.ChunkSize)
+		}
+	}
+	return n
+}
+
+// showProgress draws a progress bar on stderr until the returned function
+// is called. The rate leaves out bytes sent by an earlier run.
+func (up *uploader) showProgress(name string, total, resumed int64, sent *atomic.Int64) func() {
+	if !up.progress {
+		return func() {}
+	}
+	start := time.Now()
+	var elapsed time.Duration
+	draw := func() {
+		n := min(max(sent.Load(), 0), total)
+		if n < total || elapsed == 0 {
+			// Stop the clock at the last byte; the server assembling the
+			// file isn't transfer time
+			elapsed = time.Since(start)
+		}
+		rate := float64(max(n-resumed, 0)) / max(elapsed.Seconds(), 0.001)
+
+		const width = 30
+		filled := int(int64(width) * n / total)
+		label := name
+		if len(label) > 24 {
+			label = label[:21] + "..."
+		}
+		fmt.Fprintf(os.Stderr, "\r%-24s [%s%s] %3d%% %s/%s %s/s\033[K", label,
+			strings.Repeat("=", filled), strings.Repeat(" ", width-filled),
+			100*n/total, formatFileSize(n), formatFileSize(total), formatFileSize(int64(rate)))
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			draw()
+			select {
+			case <-ticker.C:
+			case <-done:
+				draw()
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// spoolStdin copies stdin to a temporary file so it can be sent in chunks
+func spoolStdin() (string, error) {
+	f, err := os.CreateTemp("", "kiss-drop-stdin-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("reading stdin: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func cmdUpload(c *CLI, args []string) error {
+	fs := c.flags()
+	server := fs.String("server", getEnv("KISS_DROP_SERVER", defaultServer), "server URL (default $KISS_DROP_SERVER)")
+	token := fs.String("token", os.Getenv("KISS_DROP_TOKEN"), "API key to upload with (default $KISS_DROP_TOKEN)")
+	expires := fs.String("expires", "default", `days until the share expires, "default" or "never"`)
+	name := fs.String("name", "stdin", `file name for uploads read from "-"`)
+	parallel := fs.Int("parallel", defaultParallelism, "chunks to upload at once")
+	statePath := fs.String("state", defaultStatePath(), "resume state file (empty to disable)")
+	quiet := fs.Bool("quiet", false, "don't show progress")
+	files, err := c.parse(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	if *parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cl := client.New(*server)
+	cl.Token = *token
+	up := &uploader{
+		client:   cl,
+		server:   strings.TrimSuffix(*server, "/"),
+		expires:  *expires,
+		parallel: *parallel,
+		state:    loadUploadState(*statePath),
+		progress: !*quiet && isTerminal(os.Stderr),
+	}
+
+	var results []*uploadResult
+	for _, file := range files {
+		path, fileName, resumable := file, filepath.Base(file), true
+		if file == "-" {
+			// Piped input can't be reread, so it can't be resumed either
+			if path, err = spoolStdin(); err != nil {
+				return err
+			}
+			defer os.Remove(path)
+			fileName, resumable = *name, false
+		}
+
+		result, err := up.upload(ctx, path, fileName, resumable)
+		if err != nil {
+			if resumable && ctx.Err() != nil {
+				fmt.Fprintf(os.Stderr, "Interrupted; run the same command again to resume %s\n", file)
+			}
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		result.File = file
+		results = append(results, result)
+
+		if !c.json {
+			fmt.Fprintln(c.out, result.URL)
+			if result.ManageToken != "" {
+				fmt.Fprintf(c.out, "Manage token: %s\n", result.ManageToken)
+			}
+		}
+	}
+
+	if c.json {
+		return c.printJSON(results)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// userStore opens the accounts in DATA_DIR
+func (c *CLI) userStore() (*UserStore, error) {
+	return NewUserStore(c.dataDir)
+}
+
+// findUser loads an account by name, failing if it doesn't exist
+func findUser(users *UserStore, name string) (*User, error) {
+	u, err := users.FindUser(name)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, fmt.Errorf("%s: %w", name, ErrUserNotFound)
+	}
+	return u, nil
+}
+
+// readPassword reads a password from the first line of stdin, asking for it
+// without echo when stdin is a terminal
+func readPassword(prompt string) (string, error) {
+	if isTerminal(os.Stdin) {
+		fmt.Fprint(os.Stderr, prompt)
+		if stty("-echo") == nil {
+			defer func() {
+				stty("echo")
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no password given on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// stty changes the settings of the terminal on stdin
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// parseQuota parses a quota argument: a size such as "10G", "default" for
+// DEFAULT_QUOTA or "unlimited"
+func parseQuota(s string) (int64, error) {
+	switch s {
+	case "default":
+		return 0, nil
+	case "unlimited":
+		return -1, nil
+	}
+	if n := parseSize(s); n > 0 {
+		return n, nil
+	}
+	return 0, fmt.Errorf("invalid quota %q", s)
+}
+
+// formatQuota describes an account's quota setting
+func formatQuota(quota int64) string {
+	switch {
+	case quota < 0:
+		return "unlimited"
+	case quota == 0:
+		return "default"
+	}
+	return formatFileSize(quota)
+}
+
+// UserInfo is an account as printed by the users command
+type UserInfo struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Admin     bool   `json:"admin,omitempty"`
+	Quota     int64  `json:"quota"` // 0 = default, -1 = unlimited
+	UsedBytes int64  `json:"usedBytes"`
+	APIKeys   int    `json:"apiKeys"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func cmdUsers(c *CLI, args []string) error {
+	if _, err := c.parse(c.flags(), args, 0, 0); err != nil {
+		return err
+	}
+	users, err := c.userStore()
+	if err != nil {
+		return err
+	}
+	list, err := users.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	infos := make([]UserInfo, 0, len(list))
+	for _, u := range list {
+		used, err := c.storage.OwnerUsage(u.ID)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, UserInfo{
+			ID:        u.ID,
+			Name:      u.Name,
+			Admin:     u.Admin,
+			Quota:     u.Quota,
+			UsedBytes: used,
+			APIKeys:   len(u.APIKeys),
+			CreatedAt: u.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	if c.json {
+		return c.printJSON(infos)
+	}
+	tw := c.table()
+	fmt.Fprintln(tw, "NAME\tID\tADMIN\tUSED\tQUOTA\tKEYS")
+	for _, u := range infos {
+		admin := ""
+		if u.Admin {
+			admin = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", u.Name, u.ID, admin,
+			formatFileSize(u.UsedBytes), formatQuota(u.Quota), u.APIKeys)
+	}
+	return tw.Flush()
+}
+
+func cmdUserAdd(c *CLI, args []string) error {
+	fs := c.flags()
+	admin := fs.Bool("admin", false, "let the account use the admin dashboard and APIs")
+	quota := fs.String("quota", "default", `storage quota, e.g. 10G, "default" or "unlimited"`)
+	noPassword := fs.Bool("no-password", false, "don't set a password; the account can only use API keys")
+	args, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	q, err := parseQuota(*quota)
+	if err != nil {
+		return err
+	}
+	password := ""
+	if !*noPassword {
+		if password, err = readPassword("Password: "); err != nil {
+			return err
+		}
+	}
+
+	users, err := c.userStore()
+	if err != nil {
+		return err
+	}
+	u, err := users.CreateUser(args[0], password, *admin, q)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]string{"id": u.ID, "name": u.Name})
+	}
+	fmt.Fprintf(c.out, "Created %s (%s)\n", u.Name, u.ID)
+	return nil
+}
+
+func cmdUserPasswd(c *CLI, args []string) error {
+	args, err := c.parse(c.flags(), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	users, err := c.userStore()
+	if err != nil {
+		return err
+	}
+	u, err := findUser(users, args[0])
+	if err != nil {
+		return err
+	}
+	password, err := readPassword("New password: ")
+	if err != nil {
+		return err
+	}
+	if err := users.SetPassword(u.ID, password); err != nil {
+		return err
+	}
+	if !c.json {
+		fmt.Fprintf(c.out, "Changed the password of %s\n", u.Name)
+	}
+	return nil
+}
+
+func cmdUserQuota(c *CLI, args []string) error {
+	args, err := c.parse(c.flags(), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	quota, err := parseQuota(args[1])
+	if err != nil {
+		return err
+	}
+	users, err := c.userStore()
+	if err != nil {
+		return err
+	}
+	u, err := findUser(users, args[0])
+	if err != nil {
+		return err
+	}
+	if u, err = users.UpdateUser(u.ID, func(u *User) error {
+		u.Quota = quota
+		return nil
+	}); err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]any{"name": u.Name, "quota": u.Quota})
+	}
+	fmt.Fprintf(c.out, "Quota of %s: %s\n", u.Name, formatQuota(u.Quota))
+	return nil
+}
+
+func cmdUserKey(c *CLI, args []string) error {
+	args, err := c.parse(c.flags(), args, 1, 2)
+	if err != nil {
+		return err
+	}
+	label := ""
+	if len(args) > 1 {
+		label = args[1]
+	}
+	users, err := c.userStore()
+	if err != nil {
+		return err
+	}
+	u, err := findUser(users, args[0])
+	if err != nil {
+		return err
+	}
+	token, key, err := users.CreateAPIKey(u.ID, label)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]string{"id": key.ID, "key": token})
+	}
+	fmt.Fprintln(c.out, token)
+	return nil
+}
+
+func cmdUserDelete(c *CLI, args []string) error {
+	args, err := c.parse(c.flags(), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	users, err := c.userStore()
+	if err != nil {
+		return err
+	}
+	var deleted []string
+	var failed error
+	for _, name := range args {
+		u, err := findUser(users, name)
+		if err == nil {
+			err = users.DeleteUser(u.ID)
+		}
+		if err != nil {
+			failed = errors.Join(failed, err)
+			continue
+		}
+		deleted = append(deleted, u.Name)
+	}
+
+	if c.json {
+		if err := c.printJSON(map[string][]string{"deleted": deleted}); err != nil {
+			return err
+		}
+	} else {
+		for _, name := range deleted {
+			fmt.Fprintf(c.out, "Deleted %s\n", name)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// passwordIterations is the PBKDF2-HMAC-SHA256 work factor (OWASP, 2023)
+	passwordIterations = 600_000
+	minPasswordLength  = 8
+	maxUserNameLength  = 64
+
+	// apiKeyPrefix tells API keys apart from admin and management tokens
+	apiKeyPrefix = "kd_"
+
+	sessionCookie = "kd_session"
+	sessionTTL    = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrUserExists is returned when creating a user whose name is taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotFound is returned when changing a user that doesn't exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrAPIKeyNotFound is returned when revoking a key the user doesn't have
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	// ErrInvalidUserName is returned for names that can't be used
+	ErrInvalidUserName = errors.New("user names are 1 to 64 letters, digits or . _ - @ +")
+	// ErrWeakPassword is returned for passwords that are too short
+	ErrWeakPassword = fmt.Errorf("passwords need at least %d characters", minPasswordLength)
+)
+
+// User is a local account. Shares uploaded while signed in belong to it.
+type User struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	Admin        bool      `json:"admin,omitempty"`
+	Quota        int64     `json:"quota,omitempty"` // bytes; 0 = DEFAULT_QUOTA, -1 = unlimited
+	CreatedAt    time.Time `json:"created_at"`
+	APIKeys      []APIKey  `json:"api_keys,omitempty"`
+}
+
+// APIKey is a personal token for scripts and the command line
+type APIKey struct {
+	ID        string    `json:"id"`
+	Label     string    `json:"label,omitempty"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// QuotaFor returns the user's storage limit in bytes (0 = unlimited)
+func (u *User) QuotaFor(defaultQuota int64) int64 {
+	switch {
+	case u.Quota < 0:
+		return 0
+	case u.Quota > 0:
+		return u.Quota
+	}
+	return defaultQuota
+}
+
+// validUserName reports whether a name can be used for an account. Forward
+// auth proxies send e-mail addresses, so @ and + are allowed.
+func validUserName(name string) bool {
+	if name == "" || len(name) > maxUserNameLength {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !isIDChar(c) && c != '.' && c != '@' && c != '+' {
+			return false
+		}
+	}
+	return true
+}
+
+// HashPassword returns a salted PBKDF2 hash of a password for storage
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether a password matches a hash from HashPassword
+func CheckPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+	want, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || len(want) == 0 {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// dummyPasswordHash is checked against when a user doesn't exist, so that
+// failed logins take as long for unknown names as for wrong passwords
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("not a real password")
+	return hash
+})
+
+// UserStore keeps accounts in data/users, one JSON file per user. Accounts
+// are cached in memory and reloaded when the directory changes, so edits
+// made with the command line show up in a running server.
+type UserStore struct {
+	dir        string
+	sessionKey []byte
+
+	mu       sync.Mutex
+	users    map[string]*User // by ID
+	loadedAt time.Time        // directory modification time of the cache
+}
+
+// NewUserStore creates a UserStore, generating the session signing key on
+// first use
+func NewUserStore(dataDir string) (*UserStore, error) {
+	dir := filepath.Join(dataDir, "users")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating users directory: %w", err)
+	}
+
+	keyPath := filepath.Join(dataDir, "session.key")
+	key, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		err = writeFileAtomic(keyPath, key, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("session key: %w", err)
+	}
+
+	return &UserStore{dir: dir, sessionKey: key}, nil
+}
+
+// userPath returns the path to the JSON file for a user
+func (us *UserStore) userPath(id string) string {
+	return filepath.Join(us.dir, id+".json")
+}
+
+// load refreshes the cache if the users directory changed. Callers hold us.mu.
+func (us *UserStore) load() error {
+	info, err := os.Stat(us.dir)
+	if err != nil {
+		return err
+	}
+	if us.users != nil && info.ModTime().Equal(us.loadedAt) {
+		return nil
+	}
+
+	entries, err := os.ReadDir(us.dir)
+	if err != nil {
+		return fmt.Errorf("reading users directory: %w", err)
+	}
+	users := make(map[string]*User, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue // temporary files from writeFileAtomic
+		}
+		data, err := os.ReadFile(filepath.Join(us.dir, name))
+		if err != nil {
+			continue
+		}
+		var u User
+		if err := json.Unmarshal(data, &u); err != nil || !ValidID(u.ID) {
+			continue
+		}
+		users[u.ID] = &u
+	}
+	us.users = users
+	us.loadedAt = info.ModTime()
+	return nil
+}
+
+// save writes a user to disk and the cache. Callers hold us.mu.
+func (us *UserStore) save(u *User) error {
+	data, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(us.userPath(u.ID), data, 0600); err != nil {
+		return err
+	}
+	us.users[u.ID] = u
+	return nil
+}
+
+// find returns the cached user with a name, matched case-insensitively.
+// Callers hold us.mu.
+func (us *UserStore) find(name string) *User {
+	for _, u := range us.users {
+		if strings.EqualFold(u.Name, name) {
+			return u
+		}
+	}
+	return nil
+}
+
+// copyUser returns a copy of u that callers may keep
+func copyUser(u *User) *User {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	c.APIKeys = append([]APIKey(nil), u.APIKeys...)
+	return &c
+}
+
+// CreateUser adds an account. An empty password makes an account that can
+// only be used with API keys or forward auth.
+func (us *UserStore) CreateUser(name, password string, admin bool, quota int64) (*User, error) {
+	if !validUserName(name) {
+		return nil, ErrInvalidUserName
+	}
+	u := &User{Name: name, Admin: admin, Quota: quota, CreatedAt: time.Now().UTC()}
+	if password != "" {
+		if len(password) < minPasswordLength {
+			return nil, ErrWeakPassword
+		}
+		hash, err := HashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		u.PasswordHash = hash
+	}
+	id, err := GenerateID()
+	if err != nil {
+		return nil, fmt.Errorf("generating ID: %w", err)
+	}
+	u.ID = id
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if err := us.load(); err != nil {
+		return nil, err
+	}
+	if us.find(name) != nil {
+		return nil, ErrUserExists
+	}
+	if err := us.save(u); err != nil {
+		return nil, err
+	}
+	return copyUser(u), nil
+}
+
+// GetUser returns a user by ID, or nil if there is none
+func (us *UserStore) GetUser(id string) (*User, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if err := us.load(); err != nil {
+		return nil, err
+	}
+	return copyUser(us.users[id]), nil
+}
+
+// FindUser returns a user by name, or nil if there is none
+func (us *UserStore) FindUser(name string) (*User, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if err := us.load(); err != nil {
+		return nil, err
+	}
+	return copyUser(us.find(name)), nil
+}
+
+// ListUsers returns every account, sorted by name
+func (us *UserStore) ListUsers() ([]*User, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if err := us.load(); err != nil {
+		return nil, err
+	}
+	users := make([]*User, 0, len(us.users))
+	for _, u := range us.users {
+		users = append(users, copyUser(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+// UpdateUser applies fn to a user and saves the result
+func (us *UserStore) UpdateUser(id string, fn func(*User) error) (*User, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if err := us.load(); err != nil {
+		return nil, err
+	}
+	u := copyUser(us.users[id])
+	if u == nil {
+		return nil, ErrUserNotFound
+	}
+	if err := fn(u); err != nil {
+		return nil, err
+	}
+	if err := us.save(u); err != nil {
+		return nil, err
+	}
+	return copyUser(u), nil
+}
+
+// SetPassword replaces a user's password, which also signs out their sessions
+func (us *UserStore) SetPassword(id, password string) error {
+	if len(password) < minPasswordLength {
+		return ErrWeakPassword
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = us.UpdateUser(id, func(u *User) error {
+		u.PasswordHash = hash
+		return nil
+	})
+	return err
+}
+
+// DeleteUser removes an account. Its shares are kept.
+func (us *UserStore) DeleteUser(id string) error {
+	if !ValidID(id) {
+		return ErrInvalidID
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if err := os.Remove(us.userPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	delete(us.users, id)
+	return nil
+}
+
+// Authenticate returns the user with a name and password, or nil if they
+// don't match
+func (us *UserStore) Authenticate(name, password string) (*User, error) {
+	u, err := us.FindUser(name)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || u.PasswordHash == "" {
+		CheckPassword(dummyPasswordHash(), password)
+		return nil, nil
+	}
+	if !CheckPassword(u.PasswordHash, password) {
+		return nil, nil
+	}
+	return u, nil
+}
+
+// CreateAPIKey gives a user a new API key. The key itself is only returned
+// here; the store keeps its hash.
+func (us *UserStore) CreateAPIKey(userID, label string) (string, *APIKey, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := GenerateID()
+	if err != nil {
+		return "", nil, err
+	}
+	key := APIKey{ID: id, Label: label, Hash: HashToken(apiKeyPrefix + token), CreatedAt: time.Now().UTC()}
+	if _, err := us.UpdateUser(userID, func(u *User) error {
+		u.APIKeys = append(u.APIKeys, key)
+		return nil
+	}); err != nil {
+		return "", nil, err
+	}
+	return apiKeyPrefix + token, &key, nil
+}
+
+// DeleteAPIKey revokes one of a user's API keys
+func (us *UserStore) DeleteAPIKey(userID, keyID string) error {
+	_, err := us.UpdateUser(userID, func(u *User) error {
+		for i, k := range u.APIKeys {
+			if k.ID == keyID {
+				u.APIKeys = append(u.APIKeys[:i], u.APIKeys[i+1:]...)
+				return nil
+			}
+		}
+		return ErrAPIKeyNotFound
+	})
+	return err
+}
+
+// UserForAPIKey returns the owner of an API key, or nil if no user has it
+func (us *UserStore) UserForAPIKey(key string) (*User, error) {
+	hash := HashToken(key)
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if err := us.load(); err != nil {
+		return nil, err
+	}
+	for _, u := range us.users {
+		for _, k := range u.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 {
+				return copyUser(u), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// signSession computes the signature of a session cookie. The password hash
+// is part of it, so changing the password ends existing sessions.
+func (us *UserStore) signSession(u *User, exp int64) string {
+	mac := hmac.New(sha256.New, us.sessionKey)
+	fmt.Fprintf(mac, "%s\n%d\n%s", u.ID, exp, u.PasswordHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewSession returns a session cookie that signs u in
+func (us *UserStore) NewSession(u *User, secure bool) *http.Cookie {
+	exp := time.Now().Add(sessionTTL)
+	return &http.Cookie{
+		Name:     sessionCookie,
+		Value:    u.ID + "." + strconv.FormatInt(exp.Unix(), 10) + "." + us.signSession(u, exp.Unix()),
+		Path:     "/",
+		Expires:  exp,
+		HttpOnly: true,
+		Secure:   secure,
+		// Lax keeps the cookie off cross-site POSTs, so other sites can't
+		// upload or delete in the user's name
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// SessionUser returns the user signed in by a session cookie value, or nil
+// if it is invalid or expired
+func (us *UserStore) SessionUser(value string) (*User, error) {
+	id, rest, _ := strings.Cut(value, ".")
+	expStr, sig, _ := strings.Cut(rest, ".")
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || time.Now().Unix() > exp || !ValidID(id) {
+		return nil, nil
+	}
+	u, err := us.GetUser(id)
+	if err != nil || u == nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(sig), []byte(us.signSession(u, exp))) {
+		return nil, nil
+	}
+	return u, nil
+}
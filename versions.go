@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zackgomez/kiss-drop/api"
+)
+
+// versionResponse converts a share version to its response format
+func versionResponse(v ShareVersion) api.ShareVersionResponse {
+	return api.ShareVersionResponse{
+		Version:   v.Version,
+		FileName:  v.FileName,
+		FileSize:  v.FileSize,
+		SHA256:    v.SHA256,
+		CreatedAt: v.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+}
+
+// requestedVersion resolves the ?v=N query parameter, defaulting to the
+// latest version. It writes an error and returns nil if N is not available.
+func requestedVersion(w http.ResponseWriter, r *http.Request, meta *ShareMeta) *ShareVersion {
+	vStr := r.URL.Query().Get("v")
+	if vStr == "" {
+		latest := meta.LatestVersion()
+		return &latest
+	}
+
+	n, err := strconv.Atoi(vStr)
+	if err != nil || n <= 0 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return nil
+	}
+	v := meta.FindVersion(n)
+	if v == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return nil
+	}
+	return v
+}
+
+// checkCanManage loads a share and verifies the request may modify it,
+// writing an error if not
+func (h *Handlers) checkCanManage(w http.ResponseWriter, r *http.Request, id string) bool {
+	meta, err := h.storage.GetShare(id)
+	if err != nil {
+		log.Printf("Error getting share: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	if meta == nil {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return false
+	}
+	if !h.canManage(r, meta) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// HandleShareVersions handles POST /api/share/:id/versions, which uploads a
+// new version of the file behind an existing share
+func (h *Handlers) HandleShareVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/share/")
+	id := strings.TrimSuffix(path, "/versions")
+	if !ValidID(id) {
+		http.Error(w, "Invalid share ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check authorization before accepting the body
+	if !h.checkCanManage(w, r, id) {
+		return
+	}
+	if !h.checkVersionQuota(w, id, r.ContentLength) {
+		return
+	}
+
+	r.Body = h.uploadLimit.Body(r)
+
+	// Parse multipart form (max 10GB)
+	if err := r.ParseMultipartForm(10 << 30); err != nil {
+		log.Printf("Error parsing form: %v", err)
+		http.Error(w, "Error parsing upload", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		log.Printf("Error getting file: %v", err)
+		http.Error(w, "No file provided", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	// Content-Length covers the whole form, and may be missing, so check
+	// the quota again against the file part itself
+	if !h.checkVersionQuota(w, id, header.Size) {
+		return
+	}
+
+	info := &UploadInfo{
+		UploaderIP:   h.clientIP(r),
+		UserAgent:    r.UserAgent(),
+		ContentType:  header.Header.Get("Content-Type"),
+		KeepMetadata: r.FormValue("keep_metadata") == "true",
+	}
+
+	meta, err := h.storage.AddVersion(id, file, sanitizeFileName(header.Filename), info)
+	if err != nil {
+		log.Printf("Error adding version: %v", err)
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, AuditEvent{
+		Event:    AuditVersionAdded,
+		ShareID:  meta.ID,
+		Version:  meta.CurrentVersion(),
+		Actor:    h.manageActor(r),
+		FileName: meta.FileName,
+		Bytes:    meta.FileSize,
+	})
+
+	response := map[string]any{
+		"id":      meta.ID,
+		"url":     h.shareURL(meta.ID),
+		"version": meta.CurrentVersion(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}